@@ -0,0 +1,239 @@
+package grpc_discover
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/resolver"
+)
+
+// AdminRegistration 本进程注册的实例及其心跳状态
+type AdminRegistration struct {
+	ServerID     string         `json:"server_id"`
+	ServiceName  string         `json:"service_name"`
+	Address      string         `json:"address"`
+	Status       InstanceStatus `json:"status"`
+	RegisteredAt time.Time      `json:"registered_at"`
+
+	// Heartbeat 插件是否维护心跳, consul 使用 HTTP / gRPC / TCP 检查或 WithoutCheck 时为 false
+	Heartbeat      bool      `json:"heartbeat"`
+	LastHeartbeat  time.Time `json:"last_heartbeat"`
+	HeartbeatError string    `json:"heartbeat_error,omitempty"` // 最近一次心跳失败的原因, 成功后清空
+}
+
+// AdminResolver 本进程中活跃的 resolver 及其最近一次推送给 gRPC 的状态
+type AdminResolver struct {
+	Target      string    `json:"target"`
+	Service     string    `json:"service"`
+	Addresses   []string  `json:"addresses"`
+	LastUpdate  time.Time `json:"last_update"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at"`
+}
+
+// adminState 供 admin handler 查询的本地注册和 resolver 状态, 插件始终维护
+type adminState struct {
+	mu            sync.Mutex
+	registrations map[string]*AdminRegistration
+	resolvers     map[*discoverResolver]struct{}
+}
+
+func newAdminState() *adminState {
+	return &adminState{
+		registrations: map[string]*AdminRegistration{},
+		resolvers:     map[*discoverResolver]struct{}{},
+	}
+}
+
+func (a *adminState) registered(inst Instance, heartbeat bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	reg := &AdminRegistration{
+		ServerID:     inst.ServerID,
+		ServiceName:  inst.ServiceName,
+		Address:      inst.Address,
+		Status:       inst.Status,
+		RegisteredAt: now,
+		Heartbeat:    heartbeat,
+	}
+	if heartbeat {
+		reg.LastHeartbeat = now
+	}
+	a.registrations[inst.ServerID] = reg
+}
+
+func (a *adminState) unregistered(serverID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.registrations, serverID)
+}
+
+func (a *adminState) setStatus(serverID string, status InstanceStatus) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if reg, ok := a.registrations[serverID]; ok {
+		reg.Status = status
+	}
+}
+
+// heartbeat 记录一次心跳结果, err 为 nil 表示成功
+func (a *adminState) heartbeat(serverID string, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	reg, ok := a.registrations[serverID]
+	if !ok {
+		return
+	}
+	if err != nil {
+		reg.HeartbeatError = err.Error()
+		return
+	}
+	reg.LastHeartbeat = time.Now()
+	reg.HeartbeatError = ""
+}
+
+func (a *adminState) addResolver(r *discoverResolver) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.resolvers[r] = struct{}{}
+}
+
+func (a *adminState) removeResolver(r *discoverResolver) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.resolvers, r)
+}
+
+func (a *adminState) listRegistrations() []AdminRegistration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	list := make([]AdminRegistration, 0, len(a.registrations))
+	for _, reg := range a.registrations {
+		list = append(list, *reg)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ServerID < list[j].ServerID })
+	return list
+}
+
+func (a *adminState) listResolvers() []*discoverResolver {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	list := make([]*discoverResolver, 0, len(a.resolvers))
+	for r := range a.resolvers {
+		list = append(list, r)
+	}
+	return list
+}
+
+// adminState 供 NewAdminHandler 通过接口断言取得插件的状态
+func (b *pluginBase) adminState() *adminState {
+	return b.admin
+}
+
+// NewAdminHandler 返回调试用的 HTTP handler, 以 JSON 展示本进程的注册和 resolver 状态:
+//
+//	GET  /registrations                                    本插件注册的实例和心跳状态
+//	POST /registrations/status?server_id=<id>&status=draining  修改实例状态 (见 SetStatus)
+//	GET  /resolvers                                        活跃的 resolver, 地址和最近的错误
+//	POST /resolvers/resolve?target=<target>                强制重新解析, target 为空时解析所有
+//
+// handler 没有鉴权, 只应在内网端口提供, 可以用 http.StripPrefix 挂载到前缀下:
+//
+//	mux.Handle("/discover/", http.StripPrefix("/discover", grpc_discover.NewAdminHandler(plugin)))
+func NewAdminHandler(plugin GrpcDiscoverPluginInterface) http.Handler {
+	h := &adminHandler{plugin: plugin, state: newAdminState()}
+	if p, ok := plugin.(interface{ adminState() *adminState }); ok && p.adminState() != nil {
+		h.state = p.adminState()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/registrations", h.method(http.MethodGet, h.registrations))
+	mux.HandleFunc("/registrations/status", h.method(http.MethodPost, h.setStatus))
+	mux.HandleFunc("/resolvers", h.method(http.MethodGet, h.resolvers))
+	mux.HandleFunc("/resolvers/resolve", h.method(http.MethodPost, h.resolve))
+	return mux
+}
+
+type adminHandler struct {
+	plugin GrpcDiscoverPluginInterface
+	state  *adminState
+}
+
+func (h *adminHandler) method(method string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fn(w, req)
+	}
+}
+
+func (h *adminHandler) registrations(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, h.state.listRegistrations())
+}
+
+func (h *adminHandler) setStatus(w http.ResponseWriter, req *http.Request) {
+	serverID := req.FormValue("server_id")
+	if serverID == "" {
+		http.Error(w, "server_id is required", http.StatusBadRequest)
+		return
+	}
+	status := InstanceStatus(req.FormValue("status"))
+	if err := status.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), 10*time.Second)
+	defer cancel()
+	if err := h.plugin.SetStatus(ctx, serverID, status); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, h.state.listRegistrations())
+}
+
+func (h *adminHandler) resolvers(w http.ResponseWriter, req *http.Request) {
+	resolvers := h.state.listResolvers()
+	list := make([]AdminResolver, 0, len(resolvers))
+	for _, r := range resolvers {
+		list = append(list, r.adminSnapshot())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Target < list[j].Target })
+	writeAdminJSON(w, list)
+}
+
+func (h *adminHandler) resolve(w http.ResponseWriter, req *http.Request) {
+	target := req.FormValue("target")
+	found := false
+	for _, r := range h.state.listResolvers() {
+		if target == "" || r.target.URL.String() == target {
+			r.ResolveNow(resolver.ResolveNowOptions{})
+			found = true
+		}
+	}
+	if target != "" && !found {
+		http.Error(w, errors.Errorf("no resolver for target %q", target).Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
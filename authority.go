@@ -0,0 +1,124 @@
+package grpc_discover
+
+import (
+	"crypto/tls"
+	"sync"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// AuthorityConfig dial target authority 对应注册中心的认证和 TLS 配置,
+// 为空的字段沿用插件自身的配置
+type AuthorityConfig struct {
+	Username string // etcd / redis
+	Password string // etcd / redis
+	Token    string // consul ACL token
+
+	TLS *tls.Config
+}
+
+// WithAuthority 为 dial target authority 中的注册中心单独配置认证和 TLS,
+// 例如 etcd://10.0.0.5:2379/GreeterServer 对应 authority "10.0.0.5:2379"
+func WithAuthority(authority string, config AuthorityConfig) Option {
+	return func(o *options) {
+		if o.authorities == nil {
+			o.authorities = map[string]AuthorityConfig{}
+		}
+		o.authorities[authority] = config
+	}
+}
+
+// clientCache 按 authority 懒加载并缓存注册中心客户端, 引用计数归零时关闭
+type clientCache[C any] struct {
+	dial  func(authority string) (C, error)
+	close func(C)
+
+	mu      sync.Mutex
+	clients map[string]*clientRef[C]
+	closed  bool
+}
+
+type clientRef[C any] struct {
+	client C
+	refs   int
+}
+
+func newClientCache[C any](dial func(authority string) (C, error), close func(C)) *clientCache[C] {
+	return &clientCache[C]{
+		dial:    dial,
+		close:   close,
+		clients: map[string]*clientRef[C]{},
+	}
+}
+
+// acquire 返回 authority 对应的客户端, 不再使用时调用 release
+func (c *clientCache[C]) acquire(authority string) (client C, release func(), err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return client, nil, ErrPluginClosed
+	}
+
+	ref, ex := c.clients[authority]
+	if !ex {
+		client, err = c.dial(authority)
+		if err != nil {
+			return client, nil, err
+		}
+		ref = &clientRef[C]{client: client}
+		c.clients[authority] = ref
+	}
+	ref.refs++
+
+	var once sync.Once
+	return ref.client, func() {
+		once.Do(func() { c.release(authority, ref) })
+	}, nil
+}
+
+func (c *clientCache[C]) release(authority string, ref *clientRef[C]) {
+	c.mu.Lock()
+	ref.refs--
+	if ref.refs > 0 || c.clients[authority] != ref {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.clients, authority)
+	c.mu.Unlock()
+
+	c.close(ref.client)
+}
+
+// closeAll 关闭所有客户端, 之后 acquire 返回 ErrPluginClosed
+func (c *clientCache[C]) closeAll() {
+	c.mu.Lock()
+	clients := c.clients
+	c.clients = map[string]*clientRef[C]{}
+	c.closed = true
+	c.mu.Unlock()
+
+	for _, ref := range clients {
+		c.close(ref.client)
+	}
+}
+
+// authorityResolver 关闭 resolver 时释放 authority 对应的客户端
+type authorityResolver struct {
+	resolver.Resolver
+	release func()
+}
+
+func (r *authorityResolver) Close() {
+	r.Resolver.Close()
+	r.release()
+}
+
+// releaseOnClose 将 release 绑定到 resolver 的 Close 上, 创建失败时立即释放
+func releaseOnClose(r resolver.Resolver, err error, release func()) (resolver.Resolver, error) {
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &authorityResolver{Resolver: r, release: release}, nil
+}
@@ -0,0 +1,140 @@
+package grpc_discover
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// pickerBuilder 本包 balancer 的 picker 构建器, 每个 ClientConn 一个实例,
+// 因此可以在多次重建的 picker 之间保存连接负载等状态
+type pickerBuilder interface {
+	base.PickerBuilder
+	// setState 在 base balancer 处理新的地址列表之前调用, 传入 balancer 配置和
+	// resolver 附加的信息
+	setState(balancer.ClientConnState)
+}
+
+// discoverBalancerBuilder 在 base balancer 之上实现 balancer.Builder 和
+// balancer.ConfigParser, 连接管理沿用 base balancer
+type discoverBalancerBuilder struct {
+	name        string
+	parseConfig func(json.RawMessage) (serviceconfig.LoadBalancingConfig, error)
+	newPicker   func() pickerBuilder
+}
+
+func (b *discoverBalancerBuilder) Name() string {
+	return b.name
+}
+
+func (b *discoverBalancerBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := b.newPicker()
+	return &discoverBalancer{
+		Balancer: base.NewBalancerBuilder(b.name, pb, base.Config{HealthCheck: true}).Build(cc, opts),
+		picker:   pb,
+	}
+}
+
+func (b *discoverBalancerBuilder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	return b.parseConfig(js)
+}
+
+type discoverBalancer struct {
+	balancer.Balancer
+	picker pickerBuilder
+}
+
+func (b *discoverBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	b.picker.setState(s)
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+// addressInstances 最新 resolver 状态中每个地址的注册信息. base balancer 不会更新已有
+// 连接的地址属性, 同一地址重新注册 (例如版本或元数据变化) 后 SubConnInfo 中仍是
+// 创建连接时的 Instance, picker 应当用这里的结果
+type addressInstances struct {
+	mu        sync.Mutex
+	instances map[string]Instance
+}
+
+func (a *addressInstances) update(state resolver.State) {
+	instances := make(map[string]Instance, len(state.Addresses))
+	for _, addr := range state.Addresses {
+		if inst, ok := InstanceFromAddress(addr); ok {
+			instances[addr.Addr] = inst
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.instances = instances
+}
+
+// lookup addr 当前的注册信息, 不在最新状态中时退回连接创建时的属性
+func (a *addressInstances) lookup(addr resolver.Address) (Instance, bool) {
+	a.mu.Lock()
+	inst, ok := a.instances[addr.Addr]
+	a.mu.Unlock()
+	if ok {
+		return inst, true
+	}
+	return InstanceFromAddress(addr)
+}
+
+// subConnLoads 每个连接上未完成的请求数, picker 重建后继续使用
+type subConnLoads struct {
+	mu    sync.Mutex
+	loads map[balancer.SubConn]*int64
+	total int64
+}
+
+func newSubConnLoads() *subConnLoads {
+	return &subConnLoads{loads: map[balancer.SubConn]*int64{}}
+}
+
+// sync 保留 ready 连接的计数, 移除其它连接
+func (l *subConnLoads) sync(ready map[balancer.SubConn]base.SubConnInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for sc := range l.loads {
+		if _, ok := ready[sc]; !ok {
+			delete(l.loads, sc)
+		}
+	}
+	for sc := range ready {
+		if _, ok := l.loads[sc]; !ok {
+			l.loads[sc] = new(int64)
+		}
+	}
+}
+
+func (l *subConnLoads) get(sc balancer.SubConn) *int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.loads[sc]
+}
+
+// start 记录一次请求, 返回请求结束时调用的 Done
+func (l *subConnLoads) start(load *int64) func(balancer.DoneInfo) {
+	atomic.AddInt64(load, 1)
+	atomic.AddInt64(&l.total, 1)
+	return func(balancer.DoneInfo) {
+		atomic.AddInt64(load, -1)
+		atomic.AddInt64(&l.total, -1)
+	}
+}
+
+// subConnKey 连接在哈希环等结构中的稳定标识, 优先使用 serverID,
+// 实例重新注册到其它地址时位置不变
+func subConnKey(addr resolver.Address) string {
+	if inst, ok := InstanceFromAddress(addr); ok && inst.ServerID != "" {
+		return inst.ServerID
+	}
+	return addr.Addr
+}
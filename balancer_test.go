@@ -0,0 +1,266 @@
+package grpc_discover
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"testing"
+
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+)
+
+type fakeSubConn struct {
+	balancer.SubConn
+	name string
+}
+
+func instanceAddress(inst Instance) resolver.Address {
+	return resolver.Address{Addr: inst.Address, BalancerAttributes: attributes.New(instanceKey{}, inst)}
+}
+
+// staleBuildInfo 模拟 base balancer: ready 连接的地址属性停留在 stale 中的注册信息,
+// 最新的注册信息 fresh 只出现在 resolver 状态中
+func staleBuildInfo(pb pickerBuilder, stale []Instance, fresh []Instance) (base.PickerBuildInfo, map[balancer.SubConn]string) {
+	state := resolver.State{}
+	for _, inst := range fresh {
+		state.Addresses = append(state.Addresses, instanceAddress(inst))
+	}
+	pb.setState(balancer.ClientConnState{ResolverState: state})
+
+	info := base.PickerBuildInfo{ReadySCs: map[balancer.SubConn]base.SubConnInfo{}}
+	names := map[balancer.SubConn]string{}
+	for _, inst := range stale {
+		sc := &fakeSubConn{name: inst.ServerID}
+		info.ReadySCs[sc] = base.SubConnInfo{Address: instanceAddress(inst)}
+		names[sc] = inst.ServerID
+	}
+	return info, names
+}
+
+func pickCounts(t *testing.T, p balancer.Picker, names map[balancer.SubConn]string, ctx context.Context, n int) map[string]int {
+	t.Helper()
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		res, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[names[res.SubConn]]++
+	}
+	return counts
+}
+
+func TestLeastRequestUsesLatestWeights(t *testing.T) {
+	a := Instance{ServerID: "a", Address: "10.0.0.1:80"}
+	b := Instance{ServerID: "b", Address: "10.0.0.2:80"}
+	freshA := a
+	freshA.Metadata = map[string]string{weightMetadataKey: "100"}
+
+	pb := &leastRequestPickerBuilder{loads: newSubConnLoads(), config: &leastRequestConfig{ChoiceCount: 4, WeightKey: weightMetadataKey}}
+	info, names := staleBuildInfo(pb, []Instance{a, b}, []Instance{freshA, b})
+
+	// 请求不结束, 负载持续累积; 权重相同时两边各约一半, a 的权重生效时只有
+	// 四次抽样都是 b 才会选 b
+	counts := pickCounts(t, pb.Build(info), names, context.Background(), 1000)
+	if counts["a"] < 850 {
+		t.Fatalf("picks = %v, want most on the re-weighted instance a", counts)
+	}
+}
+
+func TestTrafficSplitUsesLatestVersion(t *testing.T) {
+	a := Instance{ServerID: "a", Address: "10.0.0.1:80", Version: "v1"}
+	b := Instance{ServerID: "b", Address: "10.0.0.2:80", Version: "v1"}
+	freshA := a
+	freshA.Version = "v2"
+
+	pb := &trafficSplitPickerBuilder{config: defaultTrafficSplitConfig()}
+	info, names := staleBuildInfo(pb, []Instance{a, b}, []Instance{freshA, b})
+	pb.split = &TrafficSplit{Routes: []TrafficRoute{{Version: "v2", Weight: 100}, {Version: "v1", Weight: 0}}}
+
+	// a 以 v2 重新注册后应当拿到全部流量
+	counts := pickCounts(t, pb.Build(info), names, context.Background(), 200)
+	if counts["a"] != 200 {
+		t.Fatalf("picks = %v, want all on instance a re-registered as v2", counts)
+	}
+}
+
+func TestHeaderRoutingUsesLatestMetadata(t *testing.T) {
+	a := Instance{ServerID: "a", Address: "10.0.0.1:80", Metadata: map[string]string{"tenant": "old"}}
+	b := Instance{ServerID: "b", Address: "10.0.0.2:80"}
+	freshA := a
+	freshA.Metadata = map[string]string{"tenant": "acme"}
+
+	pb := &headerRoutingPickerBuilder{config: &headerRoutingConfig{
+		Rules:    []headerRule{{Header: "x-tenant", Match: "meta.tenant"}},
+		Fallback: headerFallbackNone,
+	}}
+	info, names := staleBuildInfo(pb, []Instance{a, b}, []Instance{freshA, b})
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-tenant", "acme")
+	counts := pickCounts(t, pb.Build(info), names, ctx, 50)
+	if counts["a"] != 50 {
+		t.Fatalf("picks = %v, want all on instance a with updated tenant", counts)
+	}
+}
+
+// ringHashFixture n 个 ready 连接的 ring hash picker builder, 连接按 serverID 复用,
+// 便于比较增删实例前后的映射
+type ringHashFixture struct {
+	pb       *ringHashPickerBuilder
+	subConns map[string]*fakeSubConn
+}
+
+func newRingHashFixture(config *ringHashConfig) *ringHashFixture {
+	return &ringHashFixture{
+		pb:       &ringHashPickerBuilder{loads: newSubConnLoads(), config: config},
+		subConns: map[string]*fakeSubConn{},
+	}
+}
+
+func (f *ringHashFixture) build(serverIDs ...string) balancer.Picker {
+	info := base.PickerBuildInfo{ReadySCs: map[balancer.SubConn]base.SubConnInfo{}}
+	for i, id := range serverIDs {
+		sc, ok := f.subConns[id]
+		if !ok {
+			sc = &fakeSubConn{name: id}
+			f.subConns[id] = sc
+		}
+		inst := Instance{ServerID: id, Address: "10.0.0." + strconv.Itoa(i) + ":80"}
+		info.ReadySCs[sc] = base.SubConnInfo{Address: instanceAddress(inst)}
+	}
+	return f.pb.Build(info)
+}
+
+// pickKey 选出 ctx 对应的实例, done 为 true 时立即结束请求
+func pickKey(t *testing.T, p balancer.Picker, ctx context.Context, done bool) string {
+	t.Helper()
+	res, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done {
+		res.Done(balancer.DoneInfo{})
+	}
+	return res.SubConn.(*fakeSubConn).name
+}
+
+func ringIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = "instance-" + strconv.Itoa(i)
+	}
+	return ids
+}
+
+func TestRingHashKeySource(t *testing.T) {
+	config := defaultRingHashConfig()
+	config.HashHeader = "x-user-id"
+	f := newRingHashFixture(config)
+	p := f.build(ringIDs(8)...)
+
+	for i := 0; i < 50; i++ {
+		key := "user-" + strconv.Itoa(i)
+		fromHeader := pickKey(t, p, metadata.AppendToOutgoingContext(context.Background(), "x-user-id", key), true)
+		fromContext := pickKey(t, p, WithHashKey(context.Background(), key), true)
+		if fromHeader != fromContext {
+			t.Fatalf("key %q: header picked %s, WithHashKey picked %s", key, fromHeader, fromContext)
+		}
+
+		// WithHashKey 优先于 metadata
+		both := WithHashKey(metadata.AppendToOutgoingContext(context.Background(), "x-user-id", "other"), key)
+		if got := pickKey(t, p, both, true); got != fromContext {
+			t.Fatalf("key %q with both sources picked %s, want %s", key, got, fromContext)
+		}
+	}
+
+	// 其它 header 不作为 key, 没有 key 的请求随机分布
+	ctx := metadata.AppendToOutgoingContext(context.Background(), defaultHashHeader, "user-1")
+	seen := map[string]bool{}
+	for i := 0; i < 200; i++ {
+		seen[pickKey(t, p, ctx, true)] = true
+	}
+	if len(seen) < 4 {
+		t.Fatalf("requests without a hash key reached %d of 8 instances", len(seen))
+	}
+}
+
+func TestRingHashMinimalRemapping(t *testing.T) {
+	f := newRingHashFixture(defaultRingHashConfig())
+	ids := ringIDs(10)
+
+	assign := func(p balancer.Picker) map[string]string {
+		m := map[string]string{}
+		for i := 0; i < 2000; i++ {
+			key := "key-" + strconv.Itoa(i)
+			m[key] = pickKey(t, p, WithHashKey(context.Background(), key), true)
+		}
+		return m
+	}
+	before := assign(f.build(ids...))
+
+	// 增加实例: 只有移到新实例的 key 变化, 约占 1/11
+	added := assign(f.build(append(ids, "instance-new")...))
+	moved := 0
+	for key, id := range added {
+		if id != before[key] {
+			moved++
+			if id != "instance-new" {
+				t.Fatalf("key %q moved from %s to %s, want only moves to the new instance", key, before[key], id)
+			}
+		}
+	}
+	if moved == 0 || moved > 2000/11*2 {
+		t.Fatalf("%d of 2000 keys moved after adding one of 11 instances", moved)
+	}
+
+	// 删除实例: 只有原来在该实例上的 key 变化
+	removed := assign(f.build(ids[1:]...))
+	for key, id := range removed {
+		if before[key] != ids[0] && id != before[key] {
+			t.Fatalf("key %q moved from %s to %s after removing %s", key, before[key], id, ids[0])
+		}
+		if id == ids[0] {
+			t.Fatalf("key %q still on removed instance", key)
+		}
+	}
+}
+
+func TestRingHashBoundedLoad(t *testing.T) {
+	f := newRingHashFixture(defaultRingHashConfig())
+	p := f.build(ringIDs(4)...)
+	ctx := WithHashKey(context.Background(), "hot")
+	home := pickKey(t, p, ctx, true)
+
+	// 请求不结束, 同一个 key 的负载超过上限后溢出到环上的下一个实例
+	counts := map[string]int{}
+	for i := 0; i < 100; i++ {
+		counts[pickKey(t, p, ctx, false)]++
+	}
+	if len(counts) < 2 {
+		t.Fatalf("picks = %v, want spillover from %s", counts, home)
+	}
+	limit := int(math.Ceil(defaultLoadFactor * 100 / 4))
+	for id, n := range counts {
+		if n > limit {
+			t.Fatalf("%s has %d in-flight requests, limit %d: %v", id, n, limit, counts)
+		}
+	}
+	if counts[home] < counts[pickOther(counts, home)] {
+		t.Fatalf("picks = %v, want most on the key's own instance %s", counts, home)
+	}
+}
+
+// pickOther counts 中除 home 之外负载最高的实例
+func pickOther(counts map[string]int, home string) string {
+	best := ""
+	for id, n := range counts {
+		if id != home && (best == "" || n > counts[best]) {
+			best = id
+		}
+	}
+	return best
+}
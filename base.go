@@ -0,0 +1,243 @@
+package grpc_discover
+
+import (
+	"context"
+	"crypto/tls"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/xid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// pluginBase 三个插件共用的配置和观测组件
+type pluginBase struct {
+	backend string
+	opt     options
+	logger  Logger
+	metrics *backendMetrics
+	tracer  trace.Tracer
+	life    *lifecycle
+	admin   *adminState // 见 NewAdminHandler
+}
+
+func newPluginBase(backend string, opts []Option) (pluginBase, error) {
+	opt := newOptions(opts)
+	if err := validateSigning(opt); err != nil {
+		return pluginBase{}, err
+	}
+	m, err := newMetrics(opt.registerer)
+	if err != nil {
+		return pluginBase{}, err
+	}
+
+	return pluginBase{
+		backend: backend,
+		opt:     opt,
+		logger:  withFields(opt.logger, fieldBackend(backend)),
+		metrics: m.backend(backend),
+		tracer:  newTracer(opt.tracerProvider),
+		life:    newLifecycle(),
+		admin:   newAdminState(),
+	}, nil
+}
+
+// pluginLogger 供包内辅助功能 (如 HealthRegistration) 使用插件的 Logger
+func (b *pluginBase) pluginLogger() Logger {
+	return b.logger
+}
+
+// tlsConfig WithTLS 生成的 *tls.Config, 未配置时返回 nil
+func (b *pluginBase) tlsConfig() (*tls.Config, error) {
+	if b.opt.tls == nil {
+		return nil, nil
+	}
+	return b.opt.tls.clientConfig(b.logger)
+}
+
+// legacyServerIDs 是否兼容旧格式, 旧格式没有 namespace
+func (b *pluginBase) legacyServerIDs() bool {
+	return b.opt.legacyServerIDs && b.opt.namespace == ""
+}
+
+// newServerID 本次注册使用的 serverID, 未指定 WithInstanceID 时随机生成
+func (b *pluginBase) newServerID(serverName string, ro registerOptions) string {
+	return b.serverIDOf(serverName, newInstanceID(ro))
+}
+
+// newInstanceID WithInstanceID 指定的实例 ID, 未指定时随机生成
+func newInstanceID(ro registerOptions) string {
+	if ro.instanceID != "" {
+		return ro.instanceID
+	}
+	return xid.New().String()
+}
+
+// serverIDOf serverName 在实例 instanceID 下的 serverID. 旧格式无法还原的实例 ID
+// (例如含 "-" 的 pod 名称) 即使开启 WithLegacyServerIDs 也使用新格式
+func (b *pluginBase) serverIDOf(serverName string, instanceID string) string {
+	if b.legacyServerIDs() {
+		serverID := getLegacyServerID(serverName, instanceID)
+		if _, name, id, err := parseServerID(serverID); err == nil && name == serverName && id == instanceID {
+			return serverID
+		}
+	}
+	return getInstanceServerID(b.opt.namespace, serverName, instanceID)
+}
+
+// serverIDPrefixes 扫描和 watch serverName 时使用的前缀, 开启 WithLegacyServerIDs 时
+// 还包括旧格式的前缀, 其结果需要用 ownsServerID 过滤
+func (b *pluginBase) serverIDPrefixes(serverName string) []string {
+	prefix := getServerIDPrefix(b.opt.namespace, serverName)
+	if b.legacyServerIDs() {
+		return []string{prefix, getLegacyServerIDPrefix(serverName)}
+	}
+	return []string{prefix}
+}
+
+// ownsServerID serverID 是否属于本插件 namespace 下的 serverName
+func (b *pluginBase) ownsServerID(serverID string, serverName string) bool {
+	return isServerIDOf(serverID, b.opt.namespace, serverName)
+}
+
+// namespaceSet 收集 serverID 所在的 namespace, 返回排序后的结果
+type namespaceSet map[string]struct{}
+
+// add 按前缀扫描时会同时扫到 service config 和流量拆分规则的 key, 跳过它们
+func (s namespaceSet) add(serverID string) {
+	if isValueKey(serverID) {
+		return
+	}
+	if namespace, _, _, err := parseServerID(serverID); err == nil {
+		s[namespace] = struct{}{}
+	}
+}
+
+// isValueKey key 是否为 service config 或流量拆分规则
+func isValueKey(key string) bool {
+	for _, root := range []string{serviceConfigRoot, trafficSplitRoot} {
+		if rest := strings.TrimPrefix(key, root); rest != key && (strings.HasPrefix(rest, "/") || strings.HasPrefix(rest, "@")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s namespaceSet) list() []string {
+	namespaces := make([]string, 0, len(s))
+	for namespace := range s {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// shutdown 插件 Close 的公共部分: 按配置反注册 registered 返回的实例 (配置了
+// WithDrainTimeout 时先一起 drain), 停止心跳和 watch 并等待后台 goroutine 退出.
+// 客户端由调用方随后关闭
+func (b *pluginBase) shutdown(ctx context.Context, registered func() []string, setStatus func(context.Context, string, InstanceStatus) error, unregister func(context.Context, string) error) error {
+	if !b.life.markClosed() {
+		return ErrPluginClosed
+	}
+
+	var firstErr error
+	if b.opt.unregisterOnClose {
+		serverIDs := registered()
+		unregisterCtx, done := b.drain(ctx, serverIDs, setStatus)
+		for _, serverID := range serverIDs {
+			if err := unregister(unregisterCtx, serverID); err != nil {
+				b.logger.Error("unregister", fieldServerID(serverID), fieldError(err))
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		done()
+	}
+
+	b.life.cancel()
+	if err := b.life.wait(ctx); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// lifecycle 插件生命周期, Close 时取消 ctx 并等待后台 goroutine
+type lifecycle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &lifecycle{ctx: ctx, cancel: cancel}
+}
+
+// markClosed 标记为已关闭, 重复调用返回 false
+func (l *lifecycle) markClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.closed = true
+	return true
+}
+
+func (l *lifecycle) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// goBackground 启动后台 goroutine, Close 会等待它退出.
+// 插件关闭后启动的 goroutine 不再等待, fn 应通过 l.ctx 尽快返回
+func (l *lifecycle) goBackground(fn func()) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		go fn()
+		return
+	}
+	l.wg.Add(1)
+	l.mu.Unlock()
+
+	go func() {
+		defer l.wg.Done()
+		fn()
+	}()
+}
+
+// watchContext 派生一个在 ctx 结束或插件关闭时结束的 context
+func (l *lifecycle) watchContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-l.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// wait 等待后台 goroutine 退出, ctx 先结束时返回 ctx.Err()
+func (l *lifecycle) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
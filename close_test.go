@@ -0,0 +1,353 @@
+package grpc_discover
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/redis/go-redis/v9"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// checkGoroutines 返回的函数等待 goroutine 数量回到调用 checkGoroutines 时的水平
+func checkGoroutines(t *testing.T) func() {
+	t.Helper()
+	before := runtime.NumGoroutine()
+	return func() {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			n := runtime.NumGoroutine()
+			if n <= before {
+				return
+			}
+			if time.Now().After(deadline) {
+				buf := make([]byte, 1<<20)
+				buf = buf[:runtime.Stack(buf, true)]
+				t.Fatalf("%d goroutines leaked:\n%s", n-before, buf)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+type fakeClientConn struct {
+	mu     sync.Mutex
+	states []resolver.State
+	errs   []error
+}
+
+func (f *fakeClientConn) UpdateState(s resolver.State) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.states = append(f.states, s)
+	return nil
+}
+
+func (f *fakeClientConn) ReportError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs = append(f.errs, err)
+}
+
+func (f *fakeClientConn) NewAddress([]resolver.Address) {}
+
+func (f *fakeClientConn) NewServiceConfig(string) {}
+
+func (f *fakeClientConn) ParseServiceConfig(string) *serviceconfig.ParseResult {
+	return &serviceconfig.ParseResult{}
+}
+
+func mustTarget(t *testing.T, target string) resolver.Target {
+	t.Helper()
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resolver.Target{URL: *u}
+}
+
+// buildAndClose 创建并关闭 resolver, 然后关闭插件
+func buildAndClose(t *testing.T, plugin GrpcDiscoverPluginInterface, target string) {
+	t.Helper()
+	r, err := plugin.Build(mustTarget(t, target), &fakeClientConn{}, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond) // 让 watch 开始工作
+	r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := plugin.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := plugin.Close(ctx); err != ErrPluginClosed {
+		t.Fatalf("second Close = %v, want ErrPluginClosed", err)
+	}
+}
+
+func TestETCDCloseNoLeak(t *testing.T) {
+	check := checkGoroutines(t)
+
+	// 没有可用的 etcd, watch 一直重试, Close 仍然要停止所有 goroutine
+	plugin, err := NewETCDPlugin(clientv3.Config{
+		Endpoints:   []string{"127.0.0.1:1"},
+		DialTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buildAndClose(t, plugin, "etcd:///GreeterServer")
+	check()
+}
+
+// fakeConsulCatalog 阻塞查询带 index 参数时一直挂起到请求取消, 其余请求返回空列表
+func fakeConsulCatalog(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Query().Get("index") != "" {
+		<-req.Context().Done()
+		return
+	}
+	w.Header().Set("X-Consul-Index", "1")
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case strings.HasPrefix(req.URL.Path, "/v1/kv/"):
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		_, _ = io.WriteString(w, "[]")
+	}
+}
+
+func TestConsulCloseNoLeak(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(fakeConsulCatalog))
+	defer srv.Close()
+	check := checkGoroutines(t)
+
+	config := consulapi.DefaultConfig()
+	config.Address = strings.TrimPrefix(srv.URL, "http://")
+	plugin, err := NewConsulPlugin(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plugin.Register("GreeterServer", "127.0.0.1:8080", WithTTLCheck(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	buildAndClose(t, plugin, "consul:///GreeterServer")
+	srv.CloseClientConnections()
+	check()
+}
+
+// fakeRedis 最小的 RESP2 服务端, 足以让 RedisPlugin 完成注册、watch 和关闭
+type fakeRedis struct {
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	commands [][]string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, conns: map[net.Conn]bool{}}
+	f.wg.Add(1)
+	go f.serve()
+	return f
+}
+
+func (f *fakeRedis) addr() string { return f.ln.Addr().String() }
+
+func (f *fakeRedis) close() {
+	f.ln.Close()
+	f.mu.Lock()
+	for c := range f.conns {
+		c.Close()
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+}
+
+func (f *fakeRedis) serve() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns[conn] = true
+		f.mu.Unlock()
+		f.wg.Add(1)
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer f.wg.Done()
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	var queued []string // MULTI 之后排队的回复, EXEC 时一起返回
+	inMulti := false
+	for {
+		args, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, args)
+		f.mu.Unlock()
+
+		reply := fakeRedisReply(args)
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "MULTI":
+			inMulti, queued = true, nil
+		case cmd == "EXEC":
+			reply = "*" + strconv.Itoa(len(queued)) + "\r\n" + strings.Join(queued, "")
+			inMulti = false
+		case inMulti:
+			queued = append(queued, reply)
+			reply = "+QUEUED\r\n"
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// sets 收到的 SET 命令的 key 和 value, 按顺序
+func (f *fakeRedis) sets() [][2]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var sets [][2]string
+	for _, args := range f.commands {
+		if strings.ToUpper(args[0]) == "SET" && len(args) > 2 {
+			sets = append(sets, [2]string{args[1], args[2]})
+		}
+	}
+	return sets
+}
+
+func readRESP(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || line[0] != '*' {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func fakeRedisReply(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "HELLO":
+		return "-ERR unknown command 'HELLO'\r\n"
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		return "$-1\r\n"
+	case "KEYS":
+		return "*0\r\n"
+	case "MGET":
+		return "*" + strconv.Itoa(len(args)-1) + "\r\n" + strings.Repeat("$-1\r\n", len(args)-1)
+	case "DEL":
+		return ":1\r\n"
+	case "MULTI":
+		return "+OK\r\n"
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		var b strings.Builder
+		kind := strings.ToLower(args[0])
+		for i, channel := range args[1:] {
+			fmt.Fprintf(&b, "*3\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n:%d\r\n", len(kind), kind, len(channel), channel, i+1)
+		}
+		return b.String()
+	}
+	return "+OK\r\n"
+}
+
+func TestRedisCloseNoLeak(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.close()
+	check := checkGoroutines(t)
+
+	plugin, err := NewRedisPlugin(&redis.Options{Addr: fake.addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plugin.Register("GreeterServer", "127.0.0.1:8080"); err != nil {
+		t.Fatal(err)
+	}
+	buildAndClose(t, plugin, "redis:///GreeterServer")
+	check()
+}
+
+func TestResolverCloseNoLeak(t *testing.T) {
+	base, err := newPluginBase("fake", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := checkGoroutines(t)
+
+	watch := func(ctx context.Context, serviceName string, cfg watchConfig) <-chan []Instance {
+		ch := make(chan []Instance)
+		go func() {
+			defer close(ch)
+			select {
+			case ch <- []Instance{{ServerID: "a", ServiceName: serviceName, Address: "127.0.0.1:1"}}:
+			case <-ctx.Done():
+				return
+			}
+			<-ctx.Done()
+		}()
+		return ch
+	}
+	value := func(ctx context.Context, key string, onError func(error)) <-chan string {
+		ch := make(chan string)
+		go func() {
+			defer close(ch)
+			<-ctx.Done()
+		}()
+		return ch
+	}
+
+	for i := 0; i < 10; i++ {
+		cc := &fakeClientConn{}
+		r, err := newDiscoverResolver(&base, watch, value, mustTarget(t, "fake:///GreeterServer"), cc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+	}
+	check()
+}
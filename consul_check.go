@@ -0,0 +1,139 @@
+package grpc_discover
+
+import (
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+type consulCheckKind int
+
+const (
+	consulCheckTTL consulCheckKind = iota // 默认, 插件后台 UpdateTTL
+	consulCheckNone
+	consulCheckHTTP
+	consulCheckGRPC
+	consulCheckTCP
+)
+
+// consul 健康检查默认值
+const (
+	defaultConsulTTL             = 10 * time.Second
+	defaultConsulCheckInterval   = 5 * time.Second
+	defaultConsulCheckTimeout    = 5 * time.Second
+	defaultConsulDeregisterAfter = 10 * time.Second
+)
+
+// consulCheck consul 健康检查配置, 只对 ConsulPlugin 生效
+type consulCheck struct {
+	kind        consulCheckKind
+	http        string
+	grpcService string
+
+	ttl             time.Duration
+	interval        time.Duration
+	timeout         time.Duration
+	deregisterAfter time.Duration
+}
+
+// WithTTLCheck consul TTL 检查, 插件在后台以 ttl/3 的间隔发送 UpdateTTL,
+// 不需要 agent 能访问到实例. 不指定检查方式时默认使用 10s 的 TTL 检查 (只对 consul 生效)
+func WithTTLCheck(ttl time.Duration) RegisterOption {
+	return func(o *registerOptions) {
+		o.check.kind = consulCheckTTL
+		o.check.ttl = ttl
+	}
+}
+
+// WithHTTPCheck consul HTTP 健康检查, url 需要能被 consul agent 访问 (只对 consul 生效)
+func WithHTTPCheck(url string) RegisterOption {
+	return func(o *registerOptions) {
+		o.check.kind = consulCheckHTTP
+		o.check.http = url
+	}
+}
+
+// WithGRPCCheck consul 原生 gRPC 健康检查, 由 agent 调用注册地址上的
+// grpc.health.v1.Health/Check, healthService 为空表示检查整个 server (只对 consul 生效)
+func WithGRPCCheck(healthService string) RegisterOption {
+	return func(o *registerOptions) {
+		o.check.kind = consulCheckGRPC
+		o.check.grpcService = healthService
+	}
+}
+
+// WithTCPCheck consul TCP 检查, agent 定期连接注册地址 (只对 consul 生效)
+func WithTCPCheck() RegisterOption {
+	return func(o *registerOptions) {
+		o.check.kind = consulCheckTCP
+	}
+}
+
+// WithoutCheck 不注册任何健康检查, 实例在反注册前一直被视为健康 (只对 consul 生效)
+func WithoutCheck() RegisterOption {
+	return func(o *registerOptions) {
+		o.check.kind = consulCheckNone
+	}
+}
+
+// WithCheckInterval HTTP / gRPC / TCP 检查间隔, 默认 5s (只对 consul 生效)
+func WithCheckInterval(d time.Duration) RegisterOption {
+	return func(o *registerOptions) {
+		o.check.interval = d
+	}
+}
+
+// WithCheckTimeout HTTP / gRPC / TCP 检查超时, 默认 5s (只对 consul 生效)
+func WithCheckTimeout(d time.Duration) RegisterOption {
+	return func(o *registerOptions) {
+		o.check.timeout = d
+	}
+}
+
+// WithDeregisterCriticalAfter 检查持续失败多久后由 consul 自动删除实例, 默认 10s (只对 consul 生效)
+func WithDeregisterCriticalAfter(d time.Duration) RegisterOption {
+	return func(o *registerOptions) {
+		o.check.deregisterAfter = d
+	}
+}
+
+// ttlInterval UpdateTTL 的发送间隔
+func (c consulCheck) ttlInterval() time.Duration {
+	return orDefault(c.ttl, defaultConsulTTL) / 3
+}
+
+// build 生成 consul 检查定义, WithoutCheck 时返回 nil
+func (c consulCheck) build(address string) *consulapi.AgentServiceCheck {
+	check := new(consulapi.AgentServiceCheck)
+	switch c.kind {
+	case consulCheckNone:
+		return nil
+	case consulCheckTTL:
+		check.TTL = orDefault(c.ttl, defaultConsulTTL).String()
+		check.Status = consulapi.HealthPassing
+	case consulCheckHTTP:
+		check.HTTP = c.http
+	case consulCheckGRPC:
+		check.GRPC = address
+		if c.grpcService != "" {
+			check.GRPC = address + "/" + c.grpcService
+		}
+	case consulCheckTCP:
+		check.TCP = address
+	}
+
+	if c.kind != consulCheckTTL {
+		check.Interval = orDefault(c.interval, defaultConsulCheckInterval).String()
+		check.Timeout = orDefault(c.timeout, defaultConsulCheckTimeout).String()
+	}
+	// 故障检查失败后 consul 自动将注册服务删除
+	check.DeregisterCriticalServiceAfter = orDefault(c.deregisterAfter, defaultConsulDeregisterAfter).String()
+	return check
+}
+
+func orDefault(d time.Duration, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
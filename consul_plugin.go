@@ -1,69 +1,442 @@
 package grpc_discover
 
 import (
-	"fmt"
-	"log"
+	"context"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
 	"google.golang.org/grpc/resolver"
 )
 
 type ConsulPlugin struct {
 	client *consulapi.Client
+	config consulapi.Config
+
+	mu           sync.Mutex
+	mapping      map[string]consulRegistration
+	tokenClients map[string]consulClient
+
+	authorities *clientCache[consulClient]
+
+	pluginBase
 }
 
-func NewConsulPlugin(config *consulapi.Config) (*ConsulPlugin, error) {
+func NewConsulPlugin(config *consulapi.Config, opts ...Option) (*ConsulPlugin, error) {
+	base, err := newPluginBase("consul", opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := base.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		if config.HttpClient != nil {
+			return nil, errors.New("grpc_discover: WithTLS cannot be used with consul Config.HttpClient")
+		}
+		if config.Transport == nil {
+			config.Transport = consulapi.DefaultConfig().Transport
+		}
+		setTransportTLS(config.Transport, tlsConfig)
+		config.Scheme = "https"
+	}
+
 	client, err := consulapi.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
 
-	return &ConsulPlugin{client: client}, err
+	c := &ConsulPlugin{
+		client:       client,
+		config:       *config,
+		mapping:      map[string]consulRegistration{},
+		tokenClients: map[string]consulClient{},
+		pluginBase:   base,
+	}
+	c.authorities = newClientCache(c.dialAuthority, consulClient.close)
+	return c, nil
 }
 
-func (c *ConsulPlugin) Register(serverName string, address string, checkAddress string) (serverID string, err error) {
-	host, port, err := net.SplitHostPort(address)
+type consulRegistration struct {
+	serverName   string
+	scope        consulScope
+	close        chan struct{}                       // 停止 TTL 心跳, RegisterGroup 注册的服务共用
+	inst         Instance                            // 未签名的注册信息, SetStatus 时重新生成 meta
+	registration *consulapi.AgentServiceRegistration // SetStatus 时重新注册
+	ttl          bool
+	group        string // RegisterGroup 的实例 ID, 单独注册时为空
+}
+
+// Register 服务注册, 健康检查通过 WithTTLCheck / WithHTTPCheck / WithGRPCCheck /
+// WithTCPCheck / WithoutCheck 配置, 默认为插件维护的 TTL 检查
+func (c *ConsulPlugin) Register(serverName string, address string, opts ...RegisterOption) (serverID string, err error) {
+	return c.RegisterContext(context.Background(), serverName, address, opts...)
+}
+
+// RegisterContext 服务注册, ctx 用于超时和链路追踪
+func (c *ConsulPlugin) RegisterContext(ctx context.Context, serverName string, address string, opts ...RegisterOption) (serverID string, err error) {
+	ro := newRegisterOptions(opts)
+
+	ctx, span := startSpan(ctx, c.tracer, "Register", "consul", attrService.String(serverName), attrAddress.String(address))
+	defer func() { endSpan(span, err) }()
+
+	if c.life.isClosed() {
+		return "", ErrPluginClosed
+	}
+
+	serverID = c.newServerID(serverName, ro)
+	span.SetAttributes(attrServerID.String(serverID))
+	registration, inst, err := c.agentRegistration(ro.instance(serverID, serverName, address), ro)
 	if err != nil {
 		return "", err
 	}
-	iport, err := strconv.Atoi(port)
+
+	// 注册服务到consul
+	agent, err := c.agent(ro.consul.token)
 	if err != nil {
 		return "", err
 	}
+	err = agent.ServiceRegisterOpts(registration, consulapi.ServiceRegisterOpts{}.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+
+	reg := consulRegistration{
+		serverName:   serverName,
+		scope:        ro.consul,
+		close:        make(chan struct{}),
+		inst:         inst,
+		registration: registration,
+		ttl:          ro.check.kind == consulCheckTTL,
+	}
+
+	c.mu.Lock()
+	old, ex := c.mapping[registration.ID]
+	c.mapping[registration.ID] = reg
+	if ex {
+		c.stopUnused(old.close)
+	} else {
+		c.metrics.registered(serverName)
+	}
+	c.mu.Unlock()
+	c.admin.registered(inst, reg.ttl)
+
+	if reg.ttl {
+		c.life.goBackground(func() { c.keepAlive(reg.close, ro.check.ttlInterval()) })
+	}
+
+	c.logger.Info("register", fieldService(serverName), fieldAddress(address), fieldServerID(registration.ID))
+
+	return registration.ID, nil
+}
+
+func (c *ConsulPlugin) UnRegister(serverID string) error {
+	return c.UnRegisterContext(context.Background(), serverID)
+}
+
+// UnRegisterContext 服务反注册, ctx 用于超时和链路追踪. 配置了 WithDrainTimeout 时
+// 先将实例标记为 draining 并等待
+func (c *ConsulPlugin) UnRegisterContext(ctx context.Context, serverID string) (err error) {
+	ctx, span := startSpan(ctx, c.tracer, "UnRegister", "consul", attrServerID.String(serverID))
+	defer func() { endSpan(span, err) }()
+
+	ctx, done := c.drain(ctx, []string{serverID}, c.SetStatus)
+	defer done()
+	return c.unregister(ctx, serverID)
+}
+
+// SetStatus 修改本插件注册的实例的状态, draining / disabled 的实例不再由 resolver 下发.
+// 状态保存在 service meta 中, 修改时重新注册实例
+func (c *ConsulPlugin) SetStatus(ctx context.Context, serverID string, status InstanceStatus) error {
+	if err := status.validate(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	reg, ex := c.mapping[serverID]
+	if !ex {
+		return errors.New("service does not exist")
+	}
+
+	agent, err := c.agentLocked(reg.scope.token)
+	if err != nil {
+		return err
+	}
+
+	reg.inst.Status = status
+	registration := *reg.registration
+	registration.Meta = consulMeta(c.signInstance(reg.inst))
+	err = agent.ServiceRegisterOpts(&registration, consulapi.ServiceRegisterOpts{}.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	if reg.ttl {
+		// 重新注册后 TTL 检查回到初始状态, 立即上报 passing, 避免实例在下一次心跳前被剔除
+		err = agent.UpdateTTLOpts("service:"+serverID, "", consulapi.HealthPassing, reg.scope.writeOptions(ctx))
+		if err != nil {
+			c.logger.Warn("keepalive", fieldServerID(serverID), fieldError(err))
+		}
+	}
+
+	reg.registration = &registration
+	c.mapping[serverID] = reg
+	c.admin.setStatus(serverID, status)
+	c.logger.Info("set status", fieldServerID(serverID), Any("status", status))
+	return nil
+}
+
+// unregister 从 agent 反注册并停止 TTL 心跳
+func (c *ConsulPlugin) unregister(ctx context.Context, serverID string) error {
+	c.mu.Lock()
+	reg, ex := c.mapping[serverID]
+	c.mu.Unlock()
+
+	err := c.client.Agent().ServiceDeregisterOpts(serverID, reg.scope.writeOptions(ctx))
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ex {
+		delete(c.mapping, serverID)
+		c.stopUnused(reg.close)
+		c.metrics.unregistered(reg.serverName)
+		c.admin.unregistered(serverID)
+	}
+	return nil
+}
+
+// agentRegistration 构造 inst 的 agent 注册信息, 相同 ID 再次注册时 agent 直接覆盖旧的
+// 注册信息. 返回地址规范化后的 inst, 与 consulInstances 解析出的地址一致
+func (c *ConsulPlugin) agentRegistration(inst Instance, ro registerOptions) (*consulapi.AgentServiceRegistration, Instance, error) {
+	address := inst.Address
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, Instance{}, err
+	}
+	iport, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, Instance{}, err
+	}
+	inst.Address = net.JoinHostPort(host, strconv.Itoa(iport))
+	for k := range inst.Metadata {
+		if isReservedConsulMeta(k) {
+			return nil, Instance{}, errors.Errorf("grpc_discover: metadata key %q is reserved in consul service meta", k)
+		}
+	}
 
-	// 创建注册到consul的服务到
 	registration := new(consulapi.AgentServiceRegistration)
-	registration.ID = getServerID(serverName)
-	registration.Name = serverName
+	registration.ID = inst.ServerID
+	registration.Name = inst.ServiceName
 	registration.Port = iport
-	//registration.Tags = tags
+	registration.Tags = ro.tags
+	registration.Meta = consulMeta(c.signInstance(inst))
 	registration.Address = host
+	registration.Namespace = ro.consul.namespace
+	registration.Partition = ro.consul.partition
 
-	// 增加consul健康检查回调函数
-	check := new(consulapi.AgentServiceCheck)
-	check.HTTP = checkAddress
-	check.Timeout = "5s"
-	check.Interval = "5s"
-	check.DeregisterCriticalServiceAfter = "10s" // 故障检查失败10s后 consul自动将注册服务删除
-	registration.Check = check
+	// 增加consul健康检查
+	registration.Check = ro.check.build(address)
+	return registration, inst, nil
+}
 
-	// 注册服务到consul
-	err = c.client.Agent().ServiceRegister(registration)
-	return registration.ID, err
+// keepAlive 定期为使用 closeCh 的注册信息上报 TTL 检查为 passing
+func (c *ConsulPlugin) keepAlive(closeCh chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closeCh:
+			return
+		case <-c.life.ctx.Done():
+			return
+		case <-ticker.C:
+			for serverID, reg := range c.members(closeCh) {
+				ctx, cancel := context.WithTimeout(c.life.ctx, 3*time.Second)
+				err := c.client.Agent().UpdateTTLOpts("service:"+serverID, "", consulapi.HealthPassing, reg.scope.writeOptions(ctx))
+				cancel()
+				c.admin.heartbeat(serverID, err)
+				if err != nil {
+					c.metrics.heartbeatFailed(reg.serverName)
+					c.logger.Warn("keepalive", fieldServerID(serverID), fieldError(err))
+				}
+			}
+		}
+	}
 }
 
-func (c *ConsulPlugin) UnRegister(serverID string) error {
-	return c.client.Agent().ServiceDeregister(serverID)
+// members 使用 closeCh 心跳的注册信息
+func (c *ConsulPlugin) members(closeCh chan struct{}) map[string]consulRegistration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	members := map[string]consulRegistration{}
+	for serverID, reg := range c.mapping {
+		if reg.close == closeCh {
+			members[serverID] = reg
+		}
+	}
+	return members
+}
+
+// stopUnused 没有注册信息再使用 closeCh 时停止其心跳. 调用方持有 c.mu
+func (c *ConsulPlugin) stopUnused(closeCh chan struct{}) {
+	for _, reg := range c.mapping {
+		if reg.close == closeCh {
+			return
+		}
+	}
+	close(closeCh)
+}
+
+// RegisterGroup 在同一个实例 ID 下注册多个服务, 共用一个 TTL 心跳. consul agent 没有
+// 批量注册接口, 任一服务注册失败时反注册已注册的服务
+func (c *ConsulPlugin) RegisterGroup(ctx context.Context, group ServiceGroup, opts ...RegisterOption) (reg GroupRegistration, err error) {
+	ro := newRegisterOptions(opts)
+
+	ctx, span := startSpan(ctx, c.tracer, "RegisterGroup", "consul", attrInstances.Int(len(group.Services)))
+	defer func() { endSpan(span, err) }()
+
+	if c.life.isClosed() {
+		return GroupRegistration{}, ErrPluginClosed
+	}
+
+	reg, instances, err := c.groupInstances(group, ro)
+	if err != nil {
+		return GroupRegistration{}, err
+	}
+	span.SetAttributes(attrGroupID.String(reg.ID))
+
+	agent, err := c.agent(ro.consul.token)
+	if err != nil {
+		return GroupRegistration{}, err
+	}
+
+	registrations := make([]*consulapi.AgentServiceRegistration, len(instances))
+	for i := range instances {
+		registrations[i], instances[i], err = c.agentRegistration(instances[i], ro)
+		if err != nil {
+			return GroupRegistration{}, err
+		}
+	}
+	for i, registration := range registrations {
+		err = agent.ServiceRegisterOpts(registration, consulapi.ServiceRegisterOpts{}.WithContext(ctx))
+		if err != nil {
+			for _, done := range registrations[:i] {
+				if err := agent.ServiceDeregisterOpts(done.ID, ro.consul.writeOptions(ctx)); err != nil {
+					c.logger.Warn("rollback register group", fieldServerID(done.ID), fieldError(err))
+				}
+			}
+			return GroupRegistration{}, err
+		}
+	}
+
+	closeCh := make(chan struct{})
+	ttl := ro.check.kind == consulCheckTTL
+
+	c.mu.Lock()
+	var replaced []chan struct{}
+	for i, inst := range instances {
+		old, ex := c.mapping[inst.ServerID]
+		c.mapping[inst.ServerID] = consulRegistration{
+			serverName:   inst.ServiceName,
+			scope:        ro.consul,
+			close:        closeCh,
+			inst:         inst,
+			registration: registrations[i],
+			ttl:          ttl,
+			group:        reg.ID,
+		}
+		if ex {
+			replaced = append(replaced, old.close)
+		} else {
+			c.metrics.registered(inst.ServiceName)
+		}
+		c.admin.registered(inst, ttl)
+	}
+	for _, old := range replaced {
+		c.stopUnused(old)
+	}
+	c.mu.Unlock()
+
+	if ttl {
+		c.life.goBackground(func() { c.keepAlive(closeCh, ro.check.ttlInterval()) })
+	}
+
+	c.logger.Info("register group", Any("group", reg.ID), Any("services", len(instances)))
+
+	return reg, nil
+}
+
+// UnRegisterGroup 反注册 RegisterGroup 注册的所有服务. 配置了 WithDrainTimeout 时
+// 先将所有服务标记为 draining 并等待
+func (c *ConsulPlugin) UnRegisterGroup(ctx context.Context, groupID string) (err error) {
+	ctx, span := startSpan(ctx, c.tracer, "UnRegisterGroup", "consul", attrGroupID.String(groupID))
+	defer func() { endSpan(span, err) }()
+
+	serverIDs := c.groupMembers(groupID)
+	if len(serverIDs) == 0 {
+		return errors.New("service group does not exist")
+	}
+	ctx, done := c.drain(ctx, serverIDs, c.SetStatus)
+	defer done()
+
+	var firstErr error
+	for _, serverID := range serverIDs {
+		if err := c.unregister(ctx, serverID); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// groupMembers RegisterGroup 注册的仍然存在的 serverID
+func (c *ConsulPlugin) groupMembers(groupID string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var serverIDs []string
+	for serverID, reg := range c.mapping {
+		if reg.group != "" && reg.group == groupID {
+			serverIDs = append(serverIDs, serverID)
+		}
+	}
+	sort.Strings(serverIDs)
+	return serverIDs
 }
 
 func (c *ConsulPlugin) AutoUnRegister(serverID string) {
 	Signal(func() {
-		c.UnRegister(serverID)
+		if err := c.UnRegister(serverID); err != nil {
+			c.logger.Error("unregister", fieldServerID(serverID), fieldError(err))
+		}
 	})
 }
 
 func (c *ConsulPlugin) DiscoverByServerName(serverName string) ([]string, error) {
+	return c.DiscoverByServerNameContext(context.Background(), serverName)
+}
+
+func (c *ConsulPlugin) DiscoverByServerNameContext(ctx context.Context, serverName string) (srvAddress []string, err error) {
+	ctx, span := startSpan(ctx, c.tracer, "DiscoverByServerName", "consul", attrService.String(serverName))
+	defer func() {
+		span.SetAttributes(attrInstances.Int(len(srvAddress)))
+		endSpan(span, err)
+	}()
+
 	//只获取健康的service
-	serviceHealthy, _, err := c.client.Health().Service(serverName, "", true, nil)
+	serviceHealthy, _, err := c.client.Health().Service(serverName, "", true, c.queryOptions(ctx, ""))
 	if err != nil {
 		return nil, err
 	}
@@ -72,17 +445,27 @@ func (c *ConsulPlugin) DiscoverByServerName(serverName string) ([]string, error)
 		return nil, ErrServiceNotFound
 	}
 
-	var srvAddress []string
-
-	for _, v := range serviceHealthy {
-		srvAddress = append(srvAddress, fmt.Sprintf("%s:%d", v.Service.Address, v.Service.Port))
+	for _, inst := range servingInstances(c.verifiedInstances(consulInstances(c.opt.namespace, serverName, serviceHealthy))) {
+		srvAddress = append(srvAddress, inst.Address)
 	}
 
 	return srvAddress, nil
 }
 
 func (c *ConsulPlugin) DiscoverByServerID(serverID string) (string, error) {
-	serviceHealthy, _, err := c.client.Health().Service(getServerNameByIDConsulVersion(serverID), "", true, nil)
+	return c.DiscoverByServerIDContext(context.Background(), serverID)
+}
+
+func (c *ConsulPlugin) DiscoverByServerIDContext(ctx context.Context, serverID string) (address string, err error) {
+	ctx, span := startSpan(ctx, c.tracer, "DiscoverByServerID", "consul", attrServerID.String(serverID))
+	defer func() { endSpan(span, err) }()
+
+	namespace, serverName, _, err := parseServerID(serverID)
+	if err != nil {
+		return "", err
+	}
+
+	serviceHealthy, _, err := c.client.Health().Service(serverName, "", true, c.queryOptions(ctx, ""))
 	if err != nil {
 		return "", err
 	}
@@ -91,63 +474,428 @@ func (c *ConsulPlugin) DiscoverByServerID(serverID string) (string, error) {
 		return "", ErrServiceNotFound
 	}
 
-	for _, v := range serviceHealthy {
-		if v.Service.ID == serverID {
-			return fmt.Sprintf("%s:%d", v.Service.Address, v.Service.Port), nil
+	for _, inst := range consulInstances(namespace, serverName, serviceHealthy) {
+		if inst.ServerID == serverID && c.verifyInstance(inst) && inst.Serving() {
+			return inst.Address, nil
 		}
 	}
 
 	return "", ErrServiceNotFound
 }
 
-func (c *ConsulPlugin) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
-	rc := &consulResolver{
-		target: target,
-		cc:     cc,
-		opts:   opts,
-		c:      c,
+// Watch 监听服务健康实例变化, 每次变化推送全量快照, ctx 结束时关闭通道
+func (c *ConsulPlugin) Watch(ctx context.Context, serviceName string) (<-chan []Instance, error) {
+	if serviceName == "" {
+		return nil, errors.New("service name is empty")
 	}
 
-	rc.ResolveNow(resolver.ResolveNowOptions{})
-	return rc, nil
+	return c.watchService(c.client, "")(ctx, serviceName, watchConfig{
+		onError: func(err error) {
+			c.logger.Warn("watch", fieldService(serviceName), fieldError(err))
+		},
+	}), nil
 }
 
-func (c *ConsulPlugin) Scheme() string {
-	return "consul"
+// consulWaitTime 阻塞查询最长等待时间
+const consulWaitTime = 5 * time.Minute
+
+// errResolveNow 阻塞查询被 ResolveNow 打断
+var errResolveNow = errors.New("resolve now")
+
+// watchService 基于 consul blocking query, 索引变化时推送, datacenter 为空表示默认数据中心
+func (c *ConsulPlugin) watchService(client *consulapi.Client, datacenter string) watchFunc {
+	return func(ctx context.Context, serviceName string, cfg watchConfig) <-chan []Instance {
+		return c.watch(ctx, client, datacenter, serviceName, cfg)
+	}
 }
 
-type consulResolver struct {
-	target resolver.Target
-	cc     resolver.ClientConn
-	opts   resolver.BuildOptions
-	c      *ConsulPlugin
+func (c *ConsulPlugin) watch(ctx context.Context, client *consulapi.Client, datacenter string, serviceName string, cfg watchConfig) <-chan []Instance {
+	set := newInstanceSet(c.verifyInstance)
+	ctx, cancel := c.life.watchContext(ctx)
+
+	c.life.goBackground(func() {
+		defer cancel()
+		defer close(set.ch)
+
+		var index uint64
+		for ctx.Err() == nil {
+			instances, lastIndex, err := c.query(ctx, client, datacenter, serviceName, index, cfg.resolveNow)
+			if err == errResolveNow {
+				index = 0
+				continue
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				cfg.onError(err)
+				index = 0
+				if !sleepContext(ctx, watchRetryInterval) {
+					return
+				}
+				continue
+			}
+
+			// 索引回退说明 consul 状态被重置, 从头开始
+			if lastIndex < index {
+				lastIndex = 0
+			}
+			index = lastIndex
+
+			set.reset(instances)
+			set.flush()
+		}
+	})
+
+	return set.ch
 }
 
-func (e *consulResolver) ResolveNow(options resolver.ResolveNowOptions) {
+// query 执行一次 (阻塞) 查询, index 为 0 时立即返回
+func (c *ConsulPlugin) query(ctx context.Context, client *consulapi.Client, datacenter string, serviceName string, index uint64, resolveNow <-chan struct{}) ([]Instance, uint64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	interrupted := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-resolveNow:
+			close(interrupted)
+			cancel()
+		case <-done:
+		}
+	}()
+
+	start := time.Now()
 	//只获取健康的service
-	serviceHealthy, _, err := e.c.client.Health().Service(e.target.Endpoint(), "", true, nil)
+	q := c.queryOptions(ctx, datacenter)
+	q.WaitIndex = index
+	q.WaitTime = consulWaitTime
+	serviceHealthy, meta, err := client.Health().Service(serviceName, "", true, q)
+	select {
+	case <-interrupted:
+		return nil, 0, errResolveNow
+	default:
+	}
+	if index == 0 || err != nil {
+		c.metrics.resolved(serviceName, start, err)
+	}
 	if err != nil {
-		log.Printf("[GRPC Discover][Consul Pugin] ResolveNow %s:///%s Error: %s \n", e.target.Scheme, e.target.Endpoint, err)
-		return
+		return nil, 0, err
 	}
 
-	if len(serviceHealthy) == 0 {
-		log.Printf("[GRPC Discover][Consul Pugin] ResolveNow %s:///%s Error: %s \n", e.target.Scheme, e.target.Endpoint, "could not find service")
-		return
+	return consulInstances(c.opt.namespace, serviceName, serviceHealthy), meta.LastIndex, nil
+}
+
+// consulInstances 转换为 Instance, 只保留 namespace 下的实例
+func consulInstances(namespace string, serviceName string, entries []*consulapi.ServiceEntry) []Instance {
+	instances := make([]Instance, 0, len(entries))
+	for _, v := range entries {
+		if consulNamespace(v.Service.ID) != namespace {
+			continue
+		}
+		inst := Instance{
+			ServerID:    v.Service.ID,
+			ServiceName: serviceName,
+			Address:     net.JoinHostPort(v.Service.Address, strconv.Itoa(v.Service.Port)),
+			Tags:        v.Service.Tags,
+			Status:      StatusServing,
+		}
+		for k, val := range v.Service.Meta {
+			switch k {
+			case consulMetaVersion:
+				inst.Version = val
+				continue
+			case consulMetaKeyID:
+				inst.sig.KeyID = val
+				continue
+			case consulMetaSignature:
+				inst.sig.Value = val
+				continue
+			case consulMetaStatus:
+				inst.Status = parseStoredStatus(val)
+				continue
+			}
+			if name := strings.TrimPrefix(k, consulMetaPortPrefix); name != k {
+				if inst.Ports == nil {
+					inst.Ports = map[string]string{}
+				}
+				inst.Ports[name] = val
+				continue
+			}
+			if inst.Metadata == nil {
+				inst.Metadata = map[string]string{}
+			}
+			inst.Metadata[k] = val
+		}
+		instances = append(instances, inst)
+	}
+	return instances
+}
+
+// consulNamespace consul 中同名服务共用一个服务名, namespace 从 service ID 中解析,
+// 不是由本库注册的实例视为默认 namespace
+func consulNamespace(serviceID string) string {
+	namespace, _, _, _ := parseServerID(serviceID)
+	return namespace
+}
+
+// 版本号和签名在 consul service meta 中的 key
+const (
+	consulMetaVersion   = "version"
+	consulMetaKeyID     = "grpc_discover_key_id"
+	consulMetaSignature = "grpc_discover_signature"
+	consulMetaStatus    = "grpc_discover_status"
+
+	consulMetaPortPrefix = "grpc_discover_port_" // 命名端口 grpc_discover_port_<name>
+)
+
+// isReservedConsulMeta key 是否为本库在 service meta 中使用的 key, 不能用于 WithMetadata
+func isReservedConsulMeta(key string) bool {
+	return key == consulMetaVersion || strings.HasPrefix(key, "grpc_discover_")
+}
+
+// consulMeta 将版本号、元数据、命名端口、状态和签名合并为 consul service meta
+func consulMeta(inst Instance) map[string]string {
+	status := inst.Status.stored()
+	if inst.Version == "" && len(inst.Metadata) == 0 && len(inst.Ports) == 0 && inst.sig.KeyID == "" && status == "" {
+		return nil
+	}
+
+	meta := make(map[string]string, len(inst.Metadata)+len(inst.Ports)+4)
+	for k, v := range inst.Metadata {
+		meta[k] = v
 	}
+	if inst.Version != "" {
+		meta[consulMetaVersion] = inst.Version
+	}
+	for name, address := range inst.Ports {
+		meta[consulMetaPortPrefix+name] = address
+	}
+	if status != "" {
+		meta[consulMetaStatus] = status
+	}
+	if inst.sig.KeyID != "" {
+		meta[consulMetaKeyID] = inst.sig.KeyID
+		meta[consulMetaSignature] = inst.sig.Value
+	}
+	return meta
+}
+
+// consulPreparedQueryInterval prepared query 不支持阻塞查询, 按此间隔轮询
+const consulPreparedQueryInterval = 5 * time.Second
+
+// watchPreparedQuery 轮询执行 prepared query, 跨数据中心 failover 由 query 定义决定
+func (c *ConsulPlugin) watchPreparedQuery(client *consulapi.Client, datacenter string, query string) watchFunc {
+	return func(ctx context.Context, serviceName string, cfg watchConfig) <-chan []Instance {
+		set := newInstanceSet(c.verifyInstance)
+		ctx, cancel := c.life.watchContext(ctx)
+
+		c.life.goBackground(func() {
+			defer cancel()
+			defer close(set.ch)
 
-	var srvAddress []resolver.Address
+			ticker := time.NewTicker(consulPreparedQueryInterval)
+			defer ticker.Stop()
+			for {
+				start := time.Now()
+				resp, _, err := client.PreparedQuery().Execute(query, c.queryOptions(ctx, datacenter))
+				if ctx.Err() != nil {
+					return
+				}
+				c.metrics.resolved(serviceName, start, err)
+				if err != nil {
+					cfg.onError(err)
+				} else {
+					entries := make([]*consulapi.ServiceEntry, 0, len(resp.Nodes))
+					for i := range resp.Nodes {
+						entries = append(entries, &resp.Nodes[i])
+					}
+					set.reset(consulInstances(c.opt.namespace, resp.Service, entries))
+					set.flush()
+				}
 
-	for _, v := range serviceHealthy {
-		srvAddress = append(srvAddress, resolver.Address{
-			Addr: fmt.Sprintf("%s:%d", v.Service.Address, v.Service.Port),
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				case <-cfg.resolveNow:
+				}
+			}
 		})
+
+		return set.ch
 	}
+}
 
-	err = e.cc.UpdateState(resolver.State{Addresses: srvAddress})
+// Namespaces 列出 consul 中存在实例的 namespace, 默认 namespace 为 "". 目录接口只返回
+// 服务名, 因此对每个含本库实例的服务再查询一次 service ID, 只应在需要时调用
+func (c *ConsulPlugin) Namespaces(ctx context.Context) ([]string, error) {
+	q := c.queryOptions(ctx, "")
+	q.Filter = namespaceFilter(q.Filter)
+	services, _, err := c.client.Catalog().Services(q)
 	if err != nil {
-		log.Printf("[GRPC Discover][Consul Pugin] ResolveNow %s:///%s Error: %s \n", e.target.Scheme, e.target.Endpoint, err)
+		return nil, err
+	}
+
+	set := namespaceSet{}
+	for name := range services {
+		entries, _, err := c.client.Catalog().Service(name, "", q)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			set.add(entry.ServiceID)
+		}
 	}
+	return set.list(), nil
 }
 
-func (e *consulResolver) Close() {}
+// namespaceFilter 只保留本库注册的实例, 与 WithConsulQueryOptions 中的 filter 同时生效
+func namespaceFilter(filter string) string {
+	own := `ServiceID matches "^` + serverIDRoot + `[-/@]"`
+	if filter == "" {
+		return own
+	}
+	return "(" + filter + ") and " + own
+}
+
+// Close 关闭插件, 默认先反注册本插件注册的实例 (见 WithUnregisterOnClose),
+// 然后停止 TTL 心跳和 watch, 关闭空闲连接
+func (c *ConsulPlugin) Close(ctx context.Context) error {
+	err := c.shutdown(ctx, c.registered, c.SetStatus, c.unregister)
+	if err == ErrPluginClosed {
+		return err
+	}
+
+	c.authorities.closeAll()
+	c.closeTokenClients()
+	if c.config.Transport != nil {
+		c.config.Transport.CloseIdleConnections()
+	}
+	return err
+}
+
+// registered 本插件注册的 serverID
+func (c *ConsulPlugin) registered() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	serverIDs := make([]string, 0, len(c.mapping))
+	for serverID := range c.mapping {
+		serverIDs = append(serverIDs, serverID)
+	}
+	return serverIDs
+}
+
+// Build 创建 resolver, target 的 authority 为数据中心 (为空表示默认数据中心),
+// 带端口的 authority 视为 consul agent 地址:
+//
+//	consul:///GreeterServer                 默认数据中心的健康实例
+//	consul://dc2/GreeterServer              dc2 数据中心的健康实例
+//	consul://dc2/query/GreeterQuery         在 dc2 执行 prepared query, 可配置跨数据中心 failover
+//	consul://10.0.0.5:8500/GreeterServer    通过 10.0.0.5:8500 上的 agent 查询
+func (c *ConsulPlugin) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	datacenter := target.URL.Host
+	if !strings.Contains(datacenter, ":") {
+		watch, watchValue := c.watchTarget(c.client, datacenter, target)
+		return newDiscoverResolver(&c.pluginBase, watch, watchValue, target, cc)
+	}
+
+	ac, release, err := c.authorities.acquire(datacenter)
+	if err != nil {
+		return nil, err
+	}
+	watch, watchValue := c.watchTarget(ac.client, "", target)
+	r, err := newDiscoverResolver(&c.pluginBase, watch, watchValue, target, cc)
+	return releaseOnClose(r, err, release)
+}
+
+// watchTarget 根据 target 的路径选择健康实例查询或 prepared query,
+// prepared query 不下发 service config 和流量拆分规则
+func (c *ConsulPlugin) watchTarget(client *consulapi.Client, datacenter string, target resolver.Target) (watchFunc, valueWatchFunc) {
+	serviceName, _ := targetEndpoint(target)
+	if query := strings.TrimPrefix(serviceName, "query/"); query != serviceName {
+		return c.watchPreparedQuery(client, datacenter, query), nil
+	}
+	return c.watchService(client, datacenter), c.watchValue(client, datacenter)
+}
+
+// SetServiceConfig 将服务的 gRPC service config JSON 写入 consul KV, resolver 会随地址
+// 一起下发, serviceConfig 为空时删除
+func (c *ConsulPlugin) SetServiceConfig(ctx context.Context, serviceName string, serviceConfig string) error {
+	if err := validateServiceConfig(serviceConfig); err != nil {
+		return err
+	}
+	return c.setValue(ctx, getServiceConfigKey(c.opt.namespace, serviceName), serviceConfig)
+}
+
+// SetTrafficSplit 将服务的流量拆分规则写入 consul KV, split 为 nil 时删除
+func (c *ConsulPlugin) SetTrafficSplit(ctx context.Context, serviceName string, split *TrafficSplit) error {
+	value, err := encodeTrafficSplit(split)
+	if err != nil {
+		return err
+	}
+	return c.setValue(ctx, getTrafficSplitKey(c.opt.namespace, serviceName), value)
+}
+
+// setValue 写入 consul KV, value 为空时删除
+func (c *ConsulPlugin) setValue(ctx context.Context, key string, value string) error {
+	w := (&consulapi.WriteOptions{}).WithContext(ctx)
+	if value == "" {
+		_, err := c.client.KV().Delete(key, w)
+		return err
+	}
+	_, err := c.client.KV().Put(&consulapi.KVPair{Key: key, Value: []byte(value)}, w)
+	return err
+}
+
+// watchValue 基于 blocking query 监听 consul KV 中的配置 key
+func (c *ConsulPlugin) watchValue(client *consulapi.Client, datacenter string) valueWatchFunc {
+	return func(ctx context.Context, key string, onError func(error)) <-chan string {
+		value := newConfigValue()
+		ctx, cancel := c.life.watchContext(ctx)
+
+		c.life.goBackground(func() {
+			defer cancel()
+			defer close(value.ch)
+
+			var index uint64
+			for ctx.Err() == nil {
+				q := c.queryOptions(ctx, datacenter)
+				q.WaitIndex = index
+				q.WaitTime = consulWaitTime
+				pair, meta, err := client.KV().Get(key, q)
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					onError(err)
+					index = 0
+					if !sleepContext(ctx, watchRetryInterval) {
+						return
+					}
+					continue
+				}
+
+				if meta.LastIndex < index {
+					index = 0
+				} else {
+					index = meta.LastIndex
+				}
+				if pair == nil {
+					value.set("")
+				} else {
+					value.set(string(pair.Value))
+				}
+			}
+		})
+
+		return value.ch
+	}
+}
+
+func (c *ConsulPlugin) Scheme() string {
+	return "consul"
+}
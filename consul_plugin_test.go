@@ -0,0 +1,296 @@
+package grpc_discover
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// fakeConsulAgent 只实现注册、TTL 和反注册接口, 记录收到的请求
+type fakeConsulAgent struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (f *fakeConsulAgent) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, req.Method+" "+req.URL.Path+" token="+req.Header.Get("X-Consul-Token"))
+	f.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeConsulAgent) count(prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func newFakeConsulPlugin(t *testing.T, opts ...Option) (*ConsulPlugin, *fakeConsulAgent) {
+	t.Helper()
+	agent := &fakeConsulAgent{}
+	srv := httptest.NewServer(agent)
+	t.Cleanup(srv.Close)
+
+	config := consulapi.DefaultConfig()
+	config.Address = strings.TrimPrefix(srv.URL, "http://")
+	plugin, err := NewConsulPlugin(config, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plugin, agent
+}
+
+// runWithin fn 未在 timeout 内返回时测试失败, 用于发现死锁
+func runWithin(t *testing.T, timeout time.Duration, name string, fn func() error) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	case <-time.After(timeout):
+		t.Fatalf("%s did not return within %s", name, timeout)
+	}
+}
+
+func TestConsulSetStatusWithToken(t *testing.T) {
+	plugin, agent := newFakeConsulPlugin(t, WithDrainTimeout(10*time.Millisecond))
+	ctx := context.Background()
+
+	serverID, err := plugin.RegisterContext(ctx, "GreeterServer", "127.0.0.1:8080",
+		WithConsulToken("secret"), WithTTLCheck(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runWithin(t, 5*time.Second, "SetStatus", func() error {
+		return plugin.SetStatus(ctx, serverID, StatusDisabled)
+	})
+	if n := agent.count("PUT /v1/agent/service/register token=secret"); n != 2 {
+		t.Fatalf("register requests with token = %d, want 2", n)
+	}
+
+	runWithin(t, 5*time.Second, "UnRegisterContext", func() error {
+		return plugin.UnRegisterContext(ctx, serverID)
+	})
+	if n := agent.count("PUT /v1/agent/service/deregister/"); n != 1 {
+		t.Fatalf("deregister requests = %d, want 1", n)
+	}
+	runWithin(t, 5*time.Second, "Close", func() error {
+		return plugin.Close(ctx)
+	})
+}
+
+func TestConsulCloseDrainsWithToken(t *testing.T) {
+	plugin, agent := newFakeConsulPlugin(t, WithDrainTimeout(10*time.Millisecond))
+	ctx := context.Background()
+
+	_, err := plugin.RegisterGroup(ctx, ServiceGroup{
+		Ports:    map[string]string{DefaultPort: "127.0.0.1:8080"},
+		Services: []GroupService{{Name: "A"}, {Name: "B"}},
+	}, WithConsulToken("secret"), WithoutCheck())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runWithin(t, 5*time.Second, "Close", func() error {
+		return plugin.Close(ctx)
+	})
+	// 注册 2 次, drain 时重新注册 2 次
+	if n := agent.count("PUT /v1/agent/service/register token=secret"); n != 4 {
+		t.Fatalf("register requests with token = %d, want 4", n)
+	}
+	if n := agent.count("PUT /v1/agent/service/deregister/"); n != 2 {
+		t.Fatalf("deregister requests = %d, want 2", n)
+	}
+}
+
+func TestConsulUnRegisterShorterThanDrain(t *testing.T) {
+	plugin, agent := newFakeConsulPlugin(t, WithDrainTimeout(time.Minute))
+	register := func() string {
+		serverID, err := plugin.Register("GreeterServer", "127.0.0.1:8080", WithoutCheck())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return serverID
+	}
+
+	// 截止时间早于 drain 超时: 等待缩短, 仍留出时间反注册
+	serverID := register()
+	ctx, cancel := context.WithTimeout(context.Background(), drainReserve+200*time.Millisecond)
+	defer cancel()
+	runWithin(t, 5*time.Second, "UnRegisterContext with deadline", func() error {
+		return plugin.UnRegisterContext(ctx, serverID)
+	})
+	if n := agent.count("PUT /v1/agent/service/deregister/"); n != 1 {
+		t.Fatalf("deregister requests = %d, want 1", n)
+	}
+
+	// drain 期间 ctx 被取消: 使用独立的 ctx 反注册
+	serverID = register()
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	runWithin(t, 5*time.Second, "UnRegisterContext with cancel", func() error {
+		return plugin.UnRegisterContext(ctx, serverID)
+	})
+	if n := agent.count("PUT /v1/agent/service/deregister/"); n != 2 {
+		t.Fatalf("deregister requests = %d, want 2", n)
+	}
+
+	// Close 同样在截止前反注册
+	register()
+	ctx, cancel = context.WithTimeout(context.Background(), drainReserve+200*time.Millisecond)
+	defer cancel()
+	runWithin(t, 5*time.Second, "Close", func() error {
+		return plugin.Close(ctx)
+	})
+	if n := agent.count("PUT /v1/agent/service/deregister/"); n != 3 {
+		t.Fatalf("deregister requests = %d, want 3", n)
+	}
+}
+
+func TestConsulRejectsReservedMetadata(t *testing.T) {
+	plugin, agent := newFakeConsulPlugin(t)
+	defer plugin.Close(context.Background())
+
+	for _, key := range []string{"version", "grpc_discover_status", "grpc_discover_port_admin"} {
+		_, err := plugin.Register("GreeterServer", "127.0.0.1:8080", WithoutCheck(),
+			WithMetadata(map[string]string{key: "x"}))
+		if err == nil || !strings.Contains(err.Error(), "reserved") {
+			t.Fatalf("Register with metadata %q = %v, want reserved key error", key, err)
+		}
+		_, err = plugin.RegisterGroup(context.Background(), ServiceGroup{
+			Ports:    map[string]string{DefaultPort: "127.0.0.1:8080"},
+			Services: []GroupService{{Name: "A"}},
+		}, WithoutCheck(), WithMetadata(map[string]string{key: "x"}))
+		if err == nil || !strings.Contains(err.Error(), "reserved") {
+			t.Fatalf("RegisterGroup with metadata %q = %v, want reserved key error", key, err)
+		}
+	}
+	if n := agent.count("PUT /v1/agent/service/register"); n != 0 {
+		t.Fatalf("register requests = %d, want 0", n)
+	}
+
+	if _, err := plugin.Register("GreeterServer", "127.0.0.1:8080", WithoutCheck(),
+		WithVersion("v2"), WithMetadata(map[string]string{"zone": "us-east-1a", "release": "v3"})); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsulNamespacesScansOwnServices(t *testing.T) {
+	// 两个服务有本库的实例, 其余服务由其它工具注册
+	catalog := map[string][]string{
+		"GreeterServer": {"grpc-discover/GreeterServer/a", "grpc-discover@prod/GreeterServer/b"},
+		"UserServer":    {"grpc-discover@staging/UserServer/c"},
+		"consul":        {"consul"},
+		"web":           {"web-1"},
+	}
+	var mu sync.Mutex
+	var lookups []string
+	var filters []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		filter := req.URL.Query().Get("filter")
+		own := func(id string) bool {
+			return !strings.Contains(filter, "grpc-discover") || strings.HasPrefix(id, "grpc-discover")
+		}
+		mu.Lock()
+		filters = append(filters, filter)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if req.URL.Path == "/v1/catalog/services" {
+			services := map[string][]string{}
+			for name, ids := range catalog {
+				for _, id := range ids {
+					if own(id) {
+						services[name] = []string{}
+					}
+				}
+			}
+			_ = json.NewEncoder(w).Encode(services)
+			return
+		}
+		name := strings.TrimPrefix(req.URL.Path, "/v1/catalog/service/")
+		mu.Lock()
+		lookups = append(lookups, name)
+		mu.Unlock()
+		var entries []map[string]string
+		for _, id := range catalog[name] {
+			if own(id) {
+				entries = append(entries, map[string]string{"ServiceID": id, "ServiceName": name})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(entries)
+	}))
+	defer srv.Close()
+
+	config := consulapi.DefaultConfig()
+	config.Address = strings.TrimPrefix(srv.URL, "http://")
+	plugin, err := NewConsulPlugin(config, WithConsulQueryOptions(consulapi.QueryOptions{Filter: `ServiceTags contains "v1"`}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.Close(context.Background())
+
+	got, err := plugin.Namespaces(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"", "prod", "staging"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("namespaces = %q, want %q", got, want)
+	}
+	sort.Strings(lookups)
+	if strings.Join(lookups, ",") != "GreeterServer,UserServer" {
+		t.Fatalf("per-service lookups = %q, want only services with own instances", lookups)
+	}
+	for _, filter := range filters {
+		if !strings.HasPrefix(filter, `(ServiceTags contains "v1") and ServiceID matches`) {
+			t.Fatalf("filter = %q, want the configured filter combined with the server ID filter", filter)
+		}
+	}
+}
+
+func TestConsulCloseReleasesTokenClients(t *testing.T) {
+	agent := &fakeConsulAgent{}
+	srv := httptest.NewServer(agent)
+	defer srv.Close()
+	check := checkGoroutines(t)
+
+	config := consulapi.DefaultConfig()
+	config.Address = strings.TrimPrefix(srv.URL, "http://")
+	config.Transport = nil // 每个 token 客户端各自创建 transport
+	plugin, err := NewConsulPlugin(config, WithDrainTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, token := range []string{"a", "b"} {
+		if _, err := plugin.RegisterContext(ctx, "GreeterServer", "127.0.0.1:8080", WithConsulToken(token), WithoutCheck()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := plugin.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(plugin.tokenClients); n != 0 {
+		t.Fatalf("%d token clients left after Close", n)
+	}
+	// 空闲连接的读写 goroutine 都已退出
+	check()
+}
@@ -0,0 +1,152 @@
+package grpc_discover
+
+import (
+	"context"
+	"net/http"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// consulScope 单次注册使用的 namespace / partition / ACL token
+type consulScope struct {
+	namespace string
+	partition string
+	token     string
+}
+
+// WithConsulNamespace 注册到指定 namespace (Consul Enterprise, 只对 consul 生效)
+func WithConsulNamespace(namespace string) RegisterOption {
+	return func(o *registerOptions) {
+		o.consul.namespace = namespace
+	}
+}
+
+// WithConsulPartition 注册到指定 admin partition (Consul Enterprise, 只对 consul 生效)
+func WithConsulPartition(partition string) RegisterOption {
+	return func(o *registerOptions) {
+		o.consul.partition = partition
+	}
+}
+
+// WithConsulToken 注册、心跳和反注册使用的 ACL token, 默认使用 Config.Token (只对 consul 生效)
+func WithConsulToken(token string) RegisterOption {
+	return func(o *registerOptions) {
+		o.consul.token = token
+	}
+}
+
+// WithConsulQueryOptions 服务发现和 resolver 查询使用的默认参数,
+// 例如 Datacenter / Namespace / Partition / Token / AllowStale, dial target 中的 datacenter 优先 (只对 consul 生效)
+func WithConsulQueryOptions(q consulapi.QueryOptions) Option {
+	return func(o *options) {
+		o.consulQuery = &q
+	}
+}
+
+// writeOptions 反注册 / UpdateTTL 使用的请求参数
+func (s consulScope) writeOptions(ctx context.Context) *consulapi.QueryOptions {
+	q := &consulapi.QueryOptions{
+		Namespace: s.namespace,
+		Partition: s.partition,
+		Token:     s.token,
+	}
+	return q.WithContext(ctx)
+}
+
+// queryOptions 查询参数, datacenter 不为空时覆盖默认数据中心
+func (c *ConsulPlugin) queryOptions(ctx context.Context, datacenter string) *consulapi.QueryOptions {
+	q := &consulapi.QueryOptions{}
+	if c.opt.consulQuery != nil {
+		*q = *c.opt.consulQuery
+	}
+	if datacenter != "" {
+		q.Datacenter = datacenter
+	}
+	return q.WithContext(ctx)
+}
+
+// agent 返回使用 token 的 agent 客户端 (按 token 缓存), token 为空时使用默认客户端
+func (c *ConsulPlugin) agent(token string) (*consulapi.Agent, error) {
+	if token == "" {
+		return c.client.Agent(), nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.agentLocked(token)
+}
+
+// agentLocked 同 agent, 调用方持有 c.mu
+func (c *ConsulPlugin) agentLocked(token string) (*consulapi.Agent, error) {
+	if token == "" {
+		return c.client.Agent(), nil
+	}
+
+	if tc, ex := c.tokenClients[token]; ex {
+		return tc.client.Agent(), nil
+	}
+
+	config := c.config
+	config.Token = token
+	if config.HttpClient == nil && config.Transport == nil {
+		// 否则 NewClient 为每个客户端创建新的 transport, Close 时无法释放
+		config.Transport = consulapi.DefaultConfig().Transport
+	}
+	client, err := consulapi.NewClient(&config)
+	if err != nil {
+		return nil, err
+	}
+	c.tokenClients[token] = consulClient{client: client, transport: config.Transport}
+	return client.Agent(), nil
+}
+
+// closeTokenClients 释放按 token 创建的客户端
+func (c *ConsulPlugin) closeTokenClients() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tc := range c.tokenClients {
+		tc.close()
+	}
+	c.tokenClients = map[string]consulClient{}
+}
+
+// consulClient 单独创建的 agent 客户端, 用于 dial target authority 或 token
+type consulClient struct {
+	client    *consulapi.Client
+	transport *http.Transport // 使用 Config.HttpClient 时为 nil
+}
+
+// close consul 客户端基于 HTTP, 释放时关闭空闲连接即可
+func (a consulClient) close() {
+	if a.transport != nil {
+		a.transport.CloseIdleConnections()
+	}
+}
+
+// dialAuthority 为 dial target authority 创建 agent 客户端
+func (c *ConsulPlugin) dialAuthority(authority string) (consulClient, error) {
+	config := c.config
+	config.Address = authority
+	config.HttpClient = nil
+	config.Transport = consulapi.DefaultConfig().Transport
+	if c.config.Transport != nil && c.config.Transport.TLSClientConfig != nil {
+		// 沿用插件自身的 TLS 配置 (WithTLS 或 Config.TLSConfig)
+		config.Transport.TLSClientConfig = c.config.Transport.TLSClientConfig.Clone()
+		config.Transport.DialTLSContext = c.config.Transport.DialTLSContext
+	}
+	if ac, ex := c.opt.authorities[authority]; ex {
+		if ac.Token != "" {
+			config.Token = ac.Token
+		}
+		if ac.TLS != nil {
+			config.Scheme = "https"
+			setTransportTLS(config.Transport, ac.TLS.Clone())
+		}
+	}
+
+	client, err := consulapi.NewClient(&config)
+	if err != nil {
+		return consulClient{}, err
+	}
+	return consulClient{client: client, transport: config.Transport}, nil
+}
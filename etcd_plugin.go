@@ -2,128 +2,454 @@ package grpc_discover
 
 import (
 	"context"
-	"log"
+	"crypto/tls"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/resolver"
 )
 
 type ETCDPlugin struct {
-	client  *clientv3.Client
-	kv      clientv3.KV
-	watcher clientv3.Watcher
-	lease   clientv3.Lease
+	client *clientv3.Client
+	config clientv3.Config
+	kv     clientv3.KV
+	lease  clientv3.Lease
+
+	authorities *clientCache[*clientv3.Client]
 
 	mu      sync.Mutex
-	mapping map[string]clientv3.LeaseID
+	mapping map[string]etcdRegistration
+
+	pluginBase
+}
+
+type etcdRegistration struct {
+	serverName string
+	leaseID    clientv3.LeaseID
+	inst       Instance // 未签名的注册信息, SetStatus 时重新编码
+	group      string   // RegisterGroup 的实例 ID, 单独注册时为空
 }
 
 // NewETCDPlugin 初始化 etcd 插件，Initialize etcd plugin
-func NewETCDPlugin(config clientv3.Config) (*ETCDPlugin, error) {
+func NewETCDPlugin(config clientv3.Config, opts ...Option) (*ETCDPlugin, error) {
+	base, err := newPluginBase("etcd", opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := base.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		config = etcdTLS(config, tlsConfig)
+	}
+
 	client, err := clientv3.New(config)
 	if err != nil {
 		return nil, err
 	}
 
 	kv := clientv3.NewKV(client)
-	watcher := clientv3.NewWatcher(client)
 	lease := clientv3.NewLease(client)
-	return &ETCDPlugin{
-		client:  client,
-		kv:      kv,
-		watcher: watcher,
-		lease:   lease,
-		mapping: map[string]clientv3.LeaseID{},
-	}, nil
+	e := &ETCDPlugin{
+		client:     client,
+		config:     config,
+		kv:         kv,
+		lease:      lease,
+		mapping:    map[string]etcdRegistration{},
+		pluginBase: base,
+	}
+	e.authorities = newClientCache(e.dialAuthority, func(client *clientv3.Client) {
+		if err := client.Close(); err != nil {
+			e.logger.Warn("close authority client", fieldError(err))
+		}
+	})
+	return e, nil
+}
+
+// dialAuthority 为 dial target authority 创建客户端, 多个 endpoint 用逗号分隔
+func (e *ETCDPlugin) dialAuthority(authority string) (*clientv3.Client, error) {
+	config := e.config
+	config.Endpoints = strings.Split(authority, ",")
+	if ac, ex := e.opt.authorities[authority]; ex {
+		if ac.Username != "" {
+			config.Username = ac.Username
+			config.Password = ac.Password
+		}
+		if ac.TLS != nil {
+			config = etcdTLS(config, ac.TLS)
+		}
+	}
+	return clientv3.New(config)
+}
+
+// etcdTLS config 使用 tlsConfig 连接 etcd. 追加的传输凭证覆盖 clientv3 根据 config.TLS
+// 创建的凭证, 每次握手按 endpoint 地址补全 ServerName
+func etcdTLS(config clientv3.Config, tlsConfig *tls.Config) clientv3.Config {
+	config.TLS = tlsConfig
+	config.DialOptions = append(append([]grpc.DialOption{}, config.DialOptions...),
+		grpc.WithTransportCredentials(newAddressCredentials(tlsConfig)))
+	return config
 }
 
 // Register 服务注册
-func (e *ETCDPlugin) Register(serverName string, address string) (serverID string, err error) {
+func (e *ETCDPlugin) Register(serverName string, address string, opts ...RegisterOption) (serverID string, err error) {
+	return e.RegisterContext(context.Background(), serverName, address, opts...)
+}
+
+// RegisterContext 服务注册, ctx 用于超时和链路追踪
+func (e *ETCDPlugin) RegisterContext(ctx context.Context, serverName string, address string, opts ...RegisterOption) (serverID string, err error) {
+	ctx, span := startSpan(ctx, e.tracer, "Register", "etcd", attrService.String(serverName), attrAddress.String(address))
+	defer func() { endSpan(span, err) }()
+
+	if e.life.isClosed() {
+		return "", ErrPluginClosed
+	}
+
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
-	serverID = getServerID(serverName)
+	ro := newRegisterOptions(opts)
+	serverID = e.newServerID(serverName, ro)
+	span.SetAttributes(attrServerID.String(serverID))
 
-	leaseID, err := e.lease.Grant(context.TODO(), 10)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	leaseID, err := e.lease.Grant(ctx, 10)
 	if err != nil {
 		return "", err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	_, err = e.kv.Put(ctx, serverID, address, clientv3.WithLease(leaseID.ID))
+	// 一次 Put 同时替换值和租约, 相同 serverID 的旧注册信息 (例如重启前的实例) 被原子覆盖
+	inst := ro.instance(serverID, serverName, address)
+	put, err := e.kv.Put(ctx, serverID, encodeInstance(e.signInstance(inst)), clientv3.WithLease(leaseID.ID), clientv3.WithPrevKV())
 	if err != nil {
+		e.revokeFailed(leaseID.ID)
 		return "", err
 	}
+	if put.PrevKv != nil {
+		e.logger.Info("replace registration", fieldService(serverName), fieldServerID(serverID))
+	}
 
-	ch, err := e.lease.KeepAlive(context.TODO(), leaseID.ID)
+	ch, err := e.lease.KeepAlive(e.life.ctx, leaseID.ID)
 	if err != nil {
+		e.revokeFailed(leaseID.ID)
 		return "", err
 	}
-	go func() {
-		for {
-			select {
-			case <-ch:
-			}
+	e.life.goBackground(func() { e.keepAlive(ch, leaseID.ID, serverID) })
+
+	old, ex := e.mapping[serverID]
+	e.mapping[serverID] = etcdRegistration{serverName: serverName, leaseID: leaseID.ID, inst: inst}
+	if ex {
+		// key 已经挂在新租约上, 撤销旧租约只会停止旧的续约
+		if err := e.revokeUnused(ctx, old.leaseID); err != nil {
+			e.logger.Warn("revoke replaced lease", fieldServerID(serverID), fieldError(err))
 		}
-	}()
-
-	e.mapping[serverID] = leaseID.ID
+	} else {
+		e.metrics.registered(serverName)
+	}
+	e.admin.registered(inst, true)
 
-	log.Printf("[GRPC Discover][ETCD Pugin] Register ServerName: %s ServerAddress: %s ServerID: %s \n", serverName, address, serverID)
+	e.logger.Info("register", fieldService(serverName), fieldAddress(address), fieldServerID(serverID))
 
 	return serverID, nil
 }
 
 // UnRegister 服务反注册
 func (e *ETCDPlugin) UnRegister(serverID string) error {
+	return e.UnRegisterContext(context.Background(), serverID)
+}
+
+// UnRegisterContext 服务反注册, ctx 用于超时和链路追踪. 配置了 WithDrainTimeout 时
+// 先将实例标记为 draining 并等待
+func (e *ETCDPlugin) UnRegisterContext(ctx context.Context, serverID string) (err error) {
+	ctx, span := startSpan(ctx, e.tracer, "UnRegister", "etcd", attrServerID.String(serverID))
+	defer func() { endSpan(span, err) }()
+
+	ctx, done := e.drain(ctx, []string{serverID}, e.SetStatus)
+	defer done()
+	return e.unregister(ctx, serverID)
+}
+
+// SetStatus 修改本插件注册的实例的状态, draining / disabled 的实例不再由 resolver 下发
+func (e *ETCDPlugin) SetStatus(ctx context.Context, serverID string, status InstanceStatus) error {
+	if err := status.validate(); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	reg, ex := e.mapping[serverID]
+	if !ex {
+		return errors.New("service does not exist")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	reg.inst.Status = status
+	_, err := e.kv.Put(ctx, serverID, encodeInstance(e.signInstance(reg.inst)), clientv3.WithLease(reg.leaseID))
+	if err != nil {
+		return err
+	}
+	e.mapping[serverID] = reg
+	e.admin.setStatus(serverID, status)
+	e.logger.Info("set status", fieldServerID(serverID), Any("status", status))
+	return nil
+}
+
+// unregister 删除注册信息并撤销租约
+func (e *ETCDPlugin) unregister(ctx context.Context, serverID string) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
-	id, ex := e.mapping[serverID]
+	reg, ex := e.mapping[serverID]
 	if !ex {
 		return errors.New("service does not exist")
 	}
+	trace.SpanFromContext(ctx).SetAttributes(attrService.String(reg.serverName))
 
-	_, err := e.kv.Delete(context.TODO(), serverID)
+	_, err := e.kv.Delete(ctx, serverID)
 	if err != nil {
 		return err
 	}
 
-	_, err = e.lease.Revoke(context.TODO(), id)
+	delete(e.mapping, serverID)
+	e.metrics.unregistered(reg.serverName)
+	e.admin.unregistered(serverID)
+
+	return e.revokeUnused(ctx, reg.leaseID)
+}
+
+// revokeUnused 撤销不再有注册信息使用的租约, 组内其它服务仍在使用时保留. 调用方持有 e.mu
+func (e *ETCDPlugin) revokeUnused(ctx context.Context, leaseID clientv3.LeaseID) error {
+	for _, reg := range e.mapping {
+		if reg.leaseID == leaseID {
+			return nil
+		}
+	}
+	_, err := e.lease.Revoke(ctx, leaseID)
 	return err
 }
 
+// revokeFailed 撤销注册失败时已经申请的租约. 注册的 ctx 可能已经超时, 因此使用独立的超时
+func (e *ETCDPlugin) revokeFailed(leaseID clientv3.LeaseID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err := e.lease.Revoke(ctx, leaseID); err != nil {
+		e.logger.Warn("revoke lease of failed registration", Any("lease", int64(leaseID)), fieldError(err))
+	}
+}
+
+// RegisterGroup 在同一个实例 ID 下注册多个服务, 所有 key 在一个事务中写入并共用一个租约
+func (e *ETCDPlugin) RegisterGroup(ctx context.Context, group ServiceGroup, opts ...RegisterOption) (reg GroupRegistration, err error) {
+	ctx, span := startSpan(ctx, e.tracer, "RegisterGroup", "etcd", attrInstances.Int(len(group.Services)))
+	defer func() { endSpan(span, err) }()
+
+	if e.life.isClosed() {
+		return GroupRegistration{}, ErrPluginClosed
+	}
+
+	reg, instances, err := e.groupInstances(group, newRegisterOptions(opts))
+	if err != nil {
+		return GroupRegistration{}, err
+	}
+	span.SetAttributes(attrGroupID.String(reg.ID))
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	leaseID, err := e.lease.Grant(ctx, 10)
+	if err != nil {
+		return GroupRegistration{}, err
+	}
+
+	ops := make([]clientv3.Op, 0, len(instances))
+	serverIDs := make([]string, 0, len(instances))
+	for _, inst := range instances {
+		ops = append(ops, clientv3.OpPut(inst.ServerID, encodeInstance(e.signInstance(inst)), clientv3.WithLease(leaseID.ID)))
+		serverIDs = append(serverIDs, inst.ServerID)
+	}
+	if _, err := e.kv.Txn(ctx).Then(ops...).Commit(); err != nil {
+		e.revokeFailed(leaseID.ID)
+		return GroupRegistration{}, err
+	}
+
+	ch, err := e.lease.KeepAlive(e.life.ctx, leaseID.ID)
+	if err != nil {
+		e.revokeFailed(leaseID.ID)
+		return GroupRegistration{}, err
+	}
+	e.life.goBackground(func() { e.keepAlive(ch, leaseID.ID, serverIDs...) })
+
+	var replaced []clientv3.LeaseID
+	for _, inst := range instances {
+		old, ex := e.mapping[inst.ServerID]
+		e.mapping[inst.ServerID] = etcdRegistration{serverName: inst.ServiceName, leaseID: leaseID.ID, inst: inst, group: reg.ID}
+		if ex {
+			replaced = append(replaced, old.leaseID)
+		} else {
+			e.metrics.registered(inst.ServiceName)
+		}
+		e.admin.registered(inst, true)
+	}
+	for _, old := range replaced {
+		if err := e.revokeUnused(ctx, old); err != nil {
+			e.logger.Warn("revoke replaced lease", Any("group", reg.ID), fieldError(err))
+		}
+	}
+
+	e.logger.Info("register group", Any("group", reg.ID), Any("services", len(instances)))
+
+	return reg, nil
+}
+
+// UnRegisterGroup 反注册 RegisterGroup 注册的所有服务, 所有 key 在一个事务中删除.
+// 配置了 WithDrainTimeout 时先将所有服务标记为 draining 并等待
+func (e *ETCDPlugin) UnRegisterGroup(ctx context.Context, groupID string) (err error) {
+	ctx, span := startSpan(ctx, e.tracer, "UnRegisterGroup", "etcd", attrGroupID.String(groupID))
+	defer func() { endSpan(span, err) }()
+
+	serverIDs := e.groupMembers(groupID)
+	if len(serverIDs) == 0 {
+		return errors.New("service group does not exist")
+	}
+	ctx, done := e.drain(ctx, serverIDs, e.SetStatus)
+	defer done()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ops := make([]clientv3.Op, 0, len(serverIDs))
+	for _, serverID := range serverIDs {
+		ops = append(ops, clientv3.OpDelete(serverID))
+	}
+	if _, err := e.kv.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return err
+	}
+
+	leases := map[clientv3.LeaseID]bool{}
+	for _, serverID := range serverIDs {
+		reg, ex := e.mapping[serverID]
+		if !ex {
+			continue
+		}
+		delete(e.mapping, serverID)
+		e.metrics.unregistered(reg.serverName)
+		e.admin.unregistered(serverID)
+		leases[reg.leaseID] = true
+	}
+	for leaseID := range leases {
+		if err := e.revokeUnused(ctx, leaseID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupMembers RegisterGroup 注册的仍然存在的 serverID
+func (e *ETCDPlugin) groupMembers(groupID string) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var serverIDs []string
+	for serverID, reg := range e.mapping {
+		if reg.group != "" && reg.group == groupID {
+			serverIDs = append(serverIDs, serverID)
+		}
+	}
+	sort.Strings(serverIDs)
+	return serverIDs
+}
+
+// keepAlive 消费续约响应, 通道关闭且 serverIDs 仍挂在这个租约上说明续约失败
+func (e *ETCDPlugin) keepAlive(ch <-chan *clientv3.LeaseKeepAliveResponse, leaseID clientv3.LeaseID, serverIDs ...string) {
+	for range ch {
+		for _, serverID := range serverIDs {
+			e.admin.heartbeat(serverID, nil)
+		}
+	}
+	if e.life.ctx.Err() != nil {
+		// 插件关闭
+		return
+	}
+
+	e.mu.Lock()
+	lost := map[string]string{}
+	for _, serverID := range serverIDs {
+		if reg, ex := e.mapping[serverID]; ex && reg.leaseID == leaseID {
+			lost[serverID] = reg.serverName
+		}
+	}
+	e.mu.Unlock()
+	for serverID, serverName := range lost {
+		e.metrics.heartbeatFailed(serverName)
+		e.admin.heartbeat(serverID, errors.New("keepalive lost"))
+		e.logger.Error("keepalive lost", fieldService(serverName), fieldServerID(serverID))
+	}
+}
+
 // AutoUnRegister 自动退出
 func (e *ETCDPlugin) AutoUnRegister(serverID string) {
 	Signal(func() {
-		e.UnRegister(serverID)
+		if err := e.UnRegister(serverID); err != nil {
+			e.logger.Error("unregister", fieldServerID(serverID), fieldError(err))
+		}
 	})
 }
 
 func (e *ETCDPlugin) DiscoverByServerName(serverName string) ([]string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	return e.DiscoverByServerNameContext(context.Background(), serverName)
+}
+
+func (e *ETCDPlugin) DiscoverByServerNameContext(ctx context.Context, serverName string) (srvAddress []string, err error) {
+	ctx, span := startSpan(ctx, e.tracer, "DiscoverByServerName", "etcd", attrService.String(serverName))
+	defer func() {
+		span.SetAttributes(attrInstances.Int(len(srvAddress)))
+		endSpan(span, err)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	get, err := e.kv.Get(ctx, getServerIDPrefix(serverName), clientv3.WithPrefix())
+	kvs, _, err := e.getService(ctx, e.kv, serverName)
 	if err != nil {
 		return nil, err
 	}
 
-	var srvAddress []string
-
-	for _, v := range get.Kvs {
-		srvAddress = append(srvAddress, string(v.Value))
+	for _, v := range kvs {
+		inst := decodeInstance(string(v.Key), serverName, string(v.Value))
+		if !inst.Serving() || !e.verifyInstance(inst) {
+			continue
+		}
+		srvAddress = append(srvAddress, inst.Address)
 	}
 
 	return srvAddress, nil
 }
 
 func (e *ETCDPlugin) DiscoverByServerID(serverID string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	return e.DiscoverByServerIDContext(context.Background(), serverID)
+}
+
+func (e *ETCDPlugin) DiscoverByServerIDContext(ctx context.Context, serverID string) (address string, err error) {
+	ctx, span := startSpan(ctx, e.tracer, "DiscoverByServerID", "etcd", attrServerID.String(serverID))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	get, err := e.kv.Get(ctx, serverID)
@@ -134,59 +460,312 @@ func (e *ETCDPlugin) DiscoverByServerID(serverID string) (string, error) {
 	if len(get.Kvs) != 1 {
 		return "", ErrServiceNotFound
 	}
-	return string(get.Kvs[0].Value), nil
+	inst := decodeInstance(serverID, "", string(get.Kvs[0].Value))
+	if !e.verifyInstance(inst) || !inst.Serving() {
+		return "", ErrServiceNotFound
+	}
+	return inst.Address, nil
 }
 
-func (e *ETCDPlugin) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
-	r := &etcdResolver{
-		target: target,
-		cc:     cc,
-		opts:   opts,
-		e:      e,
+// Watch 监听服务实例变化, 每次变化推送全量快照, ctx 结束时关闭通道
+func (e *ETCDPlugin) Watch(ctx context.Context, serviceName string) (<-chan []Instance, error) {
+	if serviceName == "" {
+		return nil, errors.New("service name is empty")
 	}
 
-	r.ResolveNow(resolver.ResolveNowOptions{})
-	return r, nil
+	return e.watch(e.client)(ctx, serviceName, watchConfig{
+		onError: func(err error) {
+			e.logger.Warn("watch", fieldService(serviceName), fieldError(err))
+		},
+	}), nil
 }
 
-func (e *ETCDPlugin) Scheme() string {
-	return "etcd"
-}
+// watch 先全量拉取再基于 revision 增量 watch, 出错或 ResolveNow 时重新拉取
+func (e *ETCDPlugin) watch(client *clientv3.Client) watchFunc {
+	return func(ctx context.Context, serviceName string, cfg watchConfig) <-chan []Instance {
+		set := newInstanceSet(e.verifyInstance)
+		ctx, cancel := e.life.watchContext(ctx)
+
+		e.life.goBackground(func() {
+			defer cancel()
+			defer close(set.ch)
+
+			for ctx.Err() == nil {
+				rev, err := e.list(ctx, client, serviceName, set)
+				if err == nil {
+					set.flush()
+					err = e.watchFrom(ctx, client, serviceName, rev, set, cfg.resolveNow)
+				}
+				if err == nil || ctx.Err() != nil {
+					continue
+				}
+
+				cfg.onError(err)
+				if !sleepContext(ctx, watchRetryInterval) {
+					return
+				}
+			}
+		})
 
-type etcdResolver struct {
-	target resolver.Target
-	cc     resolver.ClientConn
-	opts   resolver.BuildOptions
-	e      *ETCDPlugin
+		return set.ch
+	}
 }
 
-func (e *etcdResolver) ResolveNow(options resolver.ResolveNowOptions) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// list 全量拉取, 返回拉取时的 revision
+func (e *ETCDPlugin) list(ctx context.Context, client *clientv3.Client, serviceName string, set *instanceSet) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	get, err := e.e.kv.Get(ctx, getServerIDPrefix(e.target.Endpoint()), clientv3.WithPrefix())
+	start := time.Now()
+	kvs, rev, err := e.getService(ctx, client, serviceName)
+	e.metrics.resolved(serviceName, start, err)
 	if err != nil {
-		log.Printf("[GRPC Discover][ETCD Pugin] ResolveNow %s:///%s Error: %s \n", e.target.Scheme, e.target.Endpoint, err)
-		return
+		return 0, err
 	}
 
-	if get.Count == 0 {
-		log.Printf("[GRPC Discover][ETCD Pugin] ResolveNow %s:///%s Error: %s \n", e.target.Scheme, e.target.Endpoint, "could not find service")
-		return
+	instances := make([]Instance, 0, len(kvs))
+	for _, kv := range kvs {
+		instances = append(instances, decodeInstance(string(kv.Key), serviceName, string(kv.Value)))
+	}
+	set.reset(instances)
+
+	return rev, nil
+}
+
+// getService 在一个事务中读取 serviceName 的所有前缀, 返回属于它的 key 和读取时的 revision
+func (e *ETCDPlugin) getService(ctx context.Context, kv clientv3.KV, serviceName string) ([]*mvccpb.KeyValue, int64, error) {
+	prefixes := e.serverIDPrefixes(serviceName)
+	ops := make([]clientv3.Op, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		ops = append(ops, clientv3.OpGet(prefix, clientv3.WithPrefix()))
+	}
+
+	txn, err := kv.Txn(ctx).Then(ops...).Commit()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var kvs []*mvccpb.KeyValue
+	for _, resp := range txn.Responses {
+		for _, kv := range resp.GetResponseRange().Kvs {
+			if e.ownsServerID(string(kv.Key), serviceName) {
+				kvs = append(kvs, kv)
+			}
+		}
+	}
+	return kvs, txn.Header.Revision, nil
+}
+
+// watchFrom 从 rev 之后增量 watch, 返回 nil 表示需要重新全量拉取
+func (e *ETCDPlugin) watchFrom(ctx context.Context, client *clientv3.Client, serviceName string, rev int64, set *instanceSet, resolveNow <-chan struct{}) error {
+	wctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+
+	// 开启 WithLegacyServerIDs 时第二个前缀为旧格式, 否则 legacy 为 nil 永远不会就绪
+	prefixes := e.serverIDPrefixes(serviceName)
+	wch := client.Watch(wctx, prefixes[0], clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+	var legacy clientv3.WatchChan
+	if len(prefixes) > 1 {
+		legacy = client.Watch(wctx, prefixes[1], clientv3.WithPrefix(), clientv3.WithRev(rev+1))
 	}
 
-	var srvAddress []resolver.Address
+	apply := func(resp clientv3.WatchResponse, ok bool) error {
+		if !ok {
+			return errors.New("etcd watch channel closed")
+		}
+		if err := resp.Err(); err != nil {
+			return err
+		}
 
-	for _, v := range get.Kvs {
-		srvAddress = append(srvAddress, resolver.Address{
-			Addr: string(v.Value),
+		for _, ev := range resp.Events {
+			key := string(ev.Kv.Key)
+			if !e.ownsServerID(key, serviceName) {
+				continue
+			}
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				set.put(decodeInstance(key, serviceName, string(ev.Kv.Value)))
+			case clientv3.EventTypeDelete:
+				set.delete(key)
+			}
+		}
+		set.flush()
+		return nil
+	}
+
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-resolveNow:
+			return nil
+		case resp, ok := <-wch:
+			err = apply(resp, ok)
+		case resp, ok := <-legacy:
+			err = apply(resp, ok)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// SetServiceConfig 发布服务的 gRPC service config JSON, resolver 会随地址一起下发,
+// serviceConfig 为空时删除
+func (e *ETCDPlugin) SetServiceConfig(ctx context.Context, serviceName string, serviceConfig string) error {
+	if err := validateServiceConfig(serviceConfig); err != nil {
+		return err
+	}
+	return e.setValue(ctx, getServiceConfigKey(e.opt.namespace, serviceName), serviceConfig)
+}
+
+// SetTrafficSplit 发布服务的流量拆分规则, split 为 nil 时删除
+func (e *ETCDPlugin) SetTrafficSplit(ctx context.Context, serviceName string, split *TrafficSplit) error {
+	value, err := encodeTrafficSplit(split)
+	if err != nil {
+		return err
+	}
+	return e.setValue(ctx, getTrafficSplitKey(e.opt.namespace, serviceName), value)
+}
+
+// setValue 写入不带租约的配置 key, value 为空时删除
+func (e *ETCDPlugin) setValue(ctx context.Context, key string, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	if value == "" {
+		_, err := e.kv.Delete(ctx, key)
+		return err
+	}
+	_, err := e.kv.Put(ctx, key, value)
+	return err
+}
+
+// watchValue 监听配置 key
+func (e *ETCDPlugin) watchValue(client *clientv3.Client) valueWatchFunc {
+	return func(ctx context.Context, key string, onError func(error)) <-chan string {
+		value := newConfigValue()
+		ctx, cancel := e.life.watchContext(ctx)
+
+		e.life.goBackground(func() {
+			defer cancel()
+			defer close(value.ch)
+
+			for ctx.Err() == nil {
+				err := e.followKey(ctx, client, key, value)
+				if err == nil || ctx.Err() != nil {
+					continue
+				}
+
+				onError(err)
+				if !sleepContext(ctx, watchRetryInterval) {
+					return
+				}
+			}
 		})
+
+		return value.ch
+	}
+}
+
+// followKey 读取 key 后从该 revision 开始 watch, 出错时返回
+func (e *ETCDPlugin) followKey(ctx context.Context, client *clientv3.Client, key string, value *configValue) error {
+	gctx, gcancel := context.WithTimeout(ctx, 3*time.Second)
+	get, err := client.Get(gctx, key)
+	gcancel()
+	if err != nil {
+		return err
+	}
+	if len(get.Kvs) == 0 {
+		value.set("")
+	} else {
+		value.set(string(get.Kvs[0].Value))
+	}
+
+	wctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+	for resp := range client.Watch(wctx, key, clientv3.WithRev(get.Header.Revision+1)) {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+		for _, ev := range resp.Events {
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				value.set(string(ev.Kv.Value))
+			case clientv3.EventTypeDelete:
+				value.set("")
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
 	}
+	return errors.New("etcd watch channel closed")
+}
+
+// Namespaces 列出 etcd 中存在实例的 namespace, 默认 namespace 为 ""
+func (e *ETCDPlugin) Namespaces(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	get, err := e.kv.Get(ctx, serverIDRoot, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+
+	set := namespaceSet{}
+	for _, kv := range get.Kvs {
+		set.add(string(kv.Key))
+	}
+	return set.list(), nil
+}
+
+// Close 关闭插件, 默认先反注册本插件注册的实例 (见 WithUnregisterOnClose),
+// 然后停止续约和 watch, 关闭所有 etcd 客户端
+func (e *ETCDPlugin) Close(ctx context.Context) error {
+	err := e.shutdown(ctx, e.registered, e.SetStatus, e.unregister)
+	if err == ErrPluginClosed {
+		return err
+	}
+
+	e.authorities.closeAll()
+	if cerr := e.client.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// registered 本插件注册的 serverID
+func (e *ETCDPlugin) registered() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	serverIDs := make([]string, 0, len(e.mapping))
+	for serverID := range e.mapping {
+		serverIDs = append(serverIDs, serverID)
+	}
+	return serverIDs
+}
 
-	err = e.cc.UpdateState(resolver.State{Addresses: srvAddress})
+// Build 创建 resolver, target 的 authority 不为空时连接其中的 etcd 集群:
+//
+//	etcd:///GreeterServer                               插件自身的 etcd 集群
+//	etcd://10.0.0.5:2379/GreeterServer                  10.0.0.5:2379 上的 etcd 集群
+//	etcd://10.0.0.5:2379,10.0.0.6:2379/GreeterServer    多个 endpoint
+func (e *ETCDPlugin) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	if target.URL.Host == "" {
+		return newDiscoverResolver(&e.pluginBase, e.watch(e.client), e.watchValue(e.client), target, cc)
+	}
+
+	client, release, err := e.authorities.acquire(target.URL.Host)
 	if err != nil {
-		log.Printf("[GRPC Discover][ETCD Pugin] ResolveNow %s:///%s Error: %s \n", e.target.Scheme, e.target.Endpoint, err)
+		return nil, err
 	}
+	r, err := newDiscoverResolver(&e.pluginBase, e.watch(client), e.watchValue(client), target, cc)
+	return releaseOnClose(r, err, release)
 }
 
-func (e *etcdResolver) Close() {}
+func (e *ETCDPlugin) Scheme() string {
+	return "etcd"
+}
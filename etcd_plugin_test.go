@@ -0,0 +1,170 @@
+package grpc_discover
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// fakeLease 记录撤销的租约, keepAliveErr 不为 nil 时 KeepAlive 失败
+type fakeLease struct {
+	clientv3.Lease
+
+	mu           sync.Mutex
+	granted      []clientv3.LeaseID
+	revoked      []clientv3.LeaseID
+	keepAliveErr error
+}
+
+func (f *fakeLease) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := clientv3.LeaseID(len(f.granted) + 1)
+	f.granted = append(f.granted, id)
+	return &clientv3.LeaseGrantResponse{ID: id, TTL: ttl}, nil
+}
+
+func (f *fakeLease) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revoked = append(f.revoked, id)
+	return &clientv3.LeaseRevokeResponse{}, nil
+}
+
+func (f *fakeLease) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	if f.keepAliveErr != nil {
+		return nil, f.keepAliveErr
+	}
+	ch := make(chan *clientv3.LeaseKeepAliveResponse)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch, nil
+}
+
+func (f *fakeLease) revokedIDs() []clientv3.LeaseID {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]clientv3.LeaseID(nil), f.revoked...)
+}
+
+// fakeKV Put 和事务返回 err, Get 返回 values 中的值
+type fakeKV struct {
+	clientv3.KV
+	err    error
+	values map[string]string
+}
+
+func (f *fakeKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	resp := &clientv3.GetResponse{}
+	if v, ok := f.values[key]; ok {
+		resp.Kvs = []*mvccpb.KeyValue{{Key: []byte(key), Value: []byte(v)}}
+	}
+	return resp, nil
+}
+
+func (f *fakeKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &clientv3.PutResponse{}, nil
+}
+
+func (f *fakeKV) Txn(ctx context.Context) clientv3.Txn {
+	return &fakeTxn{err: f.err}
+}
+
+type fakeTxn struct {
+	clientv3.Txn
+	err error
+}
+
+func (t *fakeTxn) Then(ops ...clientv3.Op) clientv3.Txn { return t }
+
+func (t *fakeTxn) Commit() (*clientv3.TxnResponse, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	return &clientv3.TxnResponse{Succeeded: true}, nil
+}
+
+func newFakeETCDPlugin(t *testing.T, kv *fakeKV, lease *fakeLease) *ETCDPlugin {
+	t.Helper()
+	plugin, err := NewETCDPlugin(clientv3.Config{
+		Endpoints:   []string{"127.0.0.1:1"},
+		DialTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = plugin.Close(ctx)
+	})
+	plugin.kv, plugin.lease = kv, lease
+	return plugin
+}
+
+func TestETCDRegisterRevokesLeaseOnFailure(t *testing.T) {
+	fail := errors.New("boom")
+	group := ServiceGroup{
+		Ports:    map[string]string{DefaultPort: "127.0.0.1:8080"},
+		Services: []GroupService{{Name: "GreeterServer"}},
+	}
+
+	cases := []struct {
+		name  string
+		kv    *fakeKV
+		lease *fakeLease
+	}{
+		{"put", &fakeKV{err: fail}, &fakeLease{}},
+		{"keepalive", &fakeKV{}, &fakeLease{keepAliveErr: fail}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			plugin := newFakeETCDPlugin(t, c.kv, c.lease)
+
+			if _, err := plugin.Register("GreeterServer", "127.0.0.1:8080"); err != fail {
+				t.Fatalf("Register = %v, want %v", err, fail)
+			}
+			if _, err := plugin.RegisterGroup(context.Background(), group); err != fail {
+				t.Fatalf("RegisterGroup = %v, want %v", err, fail)
+			}
+			if got := c.lease.revokedIDs(); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+				t.Fatalf("revoked leases = %v, want [1 2]", got)
+			}
+			if len(plugin.mapping) != 0 {
+				t.Fatalf("mapping = %v, want empty", plugin.mapping)
+			}
+		})
+	}
+}
+
+func TestETCDDiscoverByServerIDSkipsNotServing(t *testing.T) {
+	kv := &fakeKV{values: map[string]string{}}
+	plugin := newFakeETCDPlugin(t, kv, &fakeLease{})
+
+	for _, status := range []InstanceStatus{StatusServing, StatusDraining, StatusDisabled} {
+		serverID := getInstanceServerID("", "GreeterServer", string(status))
+		inst := Instance{ServerID: serverID, ServiceName: "GreeterServer", Address: "127.0.0.1:8080", Status: status}
+		kv.values[serverID] = encodeInstance(inst)
+
+		address, err := plugin.DiscoverByServerID(serverID)
+		if status == StatusServing {
+			if err != nil || address != inst.Address {
+				t.Fatalf("DiscoverByServerID(%s) = %q, %v", status, address, err)
+			}
+			continue
+		}
+		if err != ErrServiceNotFound {
+			t.Fatalf("DiscoverByServerID(%s) = %q, %v, want ErrServiceNotFound", status, address, err)
+		}
+	}
+}
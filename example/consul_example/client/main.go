@@ -17,7 +17,7 @@ func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	config := consulapi.DefaultConfig()
 	config.Address = "127.0.0.1:8500"
-	plugin, err := grpc_discover.NewConsulPlugin(config)
+	plugin, err := grpc_discover.NewConsulPlugin(config, grpc_discover.WithLogger(grpc_discover.NewStdLogger(nil, grpc_discover.LevelInfo)))
 	if err != nil {
 		panic(err)
 	}
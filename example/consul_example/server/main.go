@@ -4,13 +4,14 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"net/http"
 
 	"github.com/dollarkillerx/grpc_discover"
 	"github.com/dollarkillerx/grpc_discover/example/proto"
 	consulapi "github.com/hashicorp/consul/api"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 func main() {
@@ -21,31 +22,25 @@ func main() {
 
 	config := consulapi.DefaultConfig()
 	config.Address = "127.0.0.1:8500"
-	plugin, err := grpc_discover.NewConsulPlugin(config)
+	plugin, err := grpc_discover.NewConsulPlugin(config, grpc_discover.WithLogger(grpc_discover.NewStdLogger(nil, grpc_discover.LevelInfo)))
 	if err != nil {
 		panic(err)
 	}
 
-	// heartbeat
-	go func() {
-		http.HandleFunc("/heartbeat", func(writer http.ResponseWriter, request *http.Request) {
-			writer.Write([]byte("ack"))
-		})
-
-		err = http.ListenAndServe("0.0.0.0:5030", nil)
-		if err != nil {
-			fmt.Println("error: ", err.Error())
-		}
-	}()
+	s := grpc.NewServer()
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(s, hs)
 
-	// 注册服务 registration service
-	serverID, err := plugin.Register("GreeterServer", lis.Addr().String(), "http://192.168.31.65:5030/heartbeat")
+	// 注册服务 registration service, consul 通过 gRPC health 检查实例状态
+	reg, err := grpc_discover.RegisterWithHealth(plugin, hs, "", "GreeterServer", lis.Addr().String())
 	if err != nil {
 		panic(err)
 	}
-	plugin.AutoUnRegister(serverID) // 自动反注册 Automatic anti-registration
+	grpc_discover.Signal(func() {
+		hs.Shutdown()
+		reg.Stop() // 反注册 anti-registration
+	})
 
-	s := grpc.NewServer()
 	proto.RegisterGreeterServer(s, &server{})
 	log.Printf("server listening at %v", lis.Addr())
 	if err := s.Serve(lis); err != nil {
@@ -18,7 +18,7 @@ func main() {
 	plugin, err := grpc_discover.NewETCDPlugin(clientv3.Config{
 		Endpoints:   []string{"127.0.0.1:2379"},
 		DialTimeout: 5 * time.Second,
-	})
+	}, grpc_discover.WithLogger(grpc_discover.NewStdLogger(nil, grpc_discover.LevelInfo)))
 	if err != nil {
 		panic(err)
 	}
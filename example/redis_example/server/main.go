@@ -21,7 +21,7 @@ func main() {
 	plugin, err := grpc_discover.NewRedisPlugin(&redis.Options{
 		Addr:     "127.0.0.1:6379",
 		Password: "root",
-	})
+	}, grpc_discover.WithLogger(grpc_discover.NewStdLogger(nil, grpc_discover.LevelInfo)))
 	if err != nil {
 		panic(err)
 	}
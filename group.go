@@ -0,0 +1,106 @@
+package grpc_discover
+
+import (
+	"regexp"
+	"sort"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+)
+
+// DefaultPort GroupService 未指定端口名时使用的端口
+const DefaultPort = "grpc"
+
+// ServiceGroup 一个进程在同一实例身份下提供的多个服务和命名端口, 见 RegisterGroup:
+//
+//	grpc_discover.ServiceGroup{
+//		Ports: map[string]string{"grpc": "10.0.0.5:8080", "admin": "10.0.0.5:9090"},
+//		Services: append(grpc_discover.ServicesOf(server, "grpc"),
+//			grpc_discover.GroupService{Name: "AdminServer", Port: "admin"}),
+//	}
+type ServiceGroup struct {
+	Ports    map[string]string // 端口名 -> 地址
+	Services []GroupService
+}
+
+// GroupService 组内的一个服务
+type GroupService struct {
+	Name string
+	Port string // 服务所在的端口名, 为空时为 DefaultPort
+}
+
+// GroupRegistration RegisterGroup 的结果
+type GroupRegistration struct {
+	ID        string            // 实例 ID, 用于 UnRegisterGroup
+	ServerIDs map[string]string // 服务名 -> serverID, 可用于 SetStatus
+}
+
+// ServicesOf 从 grpc.Server 的 GetServiceInfo 取出所有服务, 都使用 port 端口
+func ServicesOf(server *grpc.Server, port string) []GroupService {
+	info := server.GetServiceInfo()
+	services := make([]GroupService, 0, len(info))
+	for name := range info {
+		services = append(services, GroupService{Name: name, Port: port})
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services
+}
+
+// portNamePattern 端口名同时用作 consul meta key 的一部分, 只允许 consul 接受的字符
+var portNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func (g ServiceGroup) validate() error {
+	if len(g.Services) == 0 {
+		return errors.New("grpc_discover: service group has no services")
+	}
+	for name := range g.Ports {
+		if !portNamePattern.MatchString(name) {
+			return errors.Errorf("grpc_discover: invalid port name %q", name)
+		}
+	}
+
+	seen := make(map[string]bool, len(g.Services))
+	for _, s := range g.Services {
+		if s.Name == "" {
+			return errors.New("grpc_discover: service group has a service without name")
+		}
+		if seen[s.Name] {
+			return errors.Errorf("grpc_discover: service %q appears twice in the group", s.Name)
+		}
+		seen[s.Name] = true
+		if _, ok := g.Ports[s.port()]; !ok {
+			return errors.Errorf("grpc_discover: service %q uses undefined port %q", s.Name, s.port())
+		}
+	}
+	return nil
+}
+
+func (s GroupService) port() string {
+	if s.Port == "" {
+		return DefaultPort
+	}
+	return s.Port
+}
+
+// groupInstances 为组内每个服务构造 Instance, 所有服务共用一个实例 ID
+func (b *pluginBase) groupInstances(group ServiceGroup, ro registerOptions) (GroupRegistration, []Instance, error) {
+	if err := group.validate(); err != nil {
+		return GroupRegistration{}, nil, err
+	}
+
+	ports := make(map[string]string, len(group.Ports))
+	for name, address := range group.Ports {
+		ports[name] = address
+	}
+
+	reg := GroupRegistration{ID: newInstanceID(ro), ServerIDs: make(map[string]string, len(group.Services))}
+	instances := make([]Instance, 0, len(group.Services))
+	for _, s := range group.Services {
+		serverID := b.serverIDOf(s.Name, reg.ID)
+		inst := ro.instance(serverID, s.Name, ports[s.port()])
+		inst.Ports = ports
+		reg.ServerIDs[s.Name] = serverID
+		instances = append(instances, inst)
+	}
+	return reg, instances, nil
+}
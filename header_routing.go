@@ -0,0 +1,160 @@
+package grpc_discover
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
+)
+
+// HeaderRoutingBalancerName 按请求 metadata 选择实例子集的 balancer 名称:
+//
+//	{"loadBalancingConfig":[{"grpc_discover_header_routing":{
+//		"rules":[{"header":"x-route-to","match":"tag"},{"header":"x-tenant","match":"meta.tenant"}],
+//		"fallback":"all"}}]}
+const HeaderRoutingBalancerName = "grpc_discover_header_routing"
+
+const (
+	headerFallbackAll  = "all"
+	headerFallbackNone = "none"
+)
+
+func init() {
+	balancer.Register(&discoverBalancerBuilder{
+		name:        HeaderRoutingBalancerName,
+		parseConfig: parseHeaderRoutingConfig,
+		newPicker: func() pickerBuilder {
+			return &headerRoutingPickerBuilder{config: &headerRoutingConfig{Fallback: headerFallbackAll}}
+		},
+	})
+}
+
+type headerRule struct {
+	Header string `json:"header"`
+	Match  string `json:"match"` // version、tag、zone 或 meta.<key>
+}
+
+type headerRoutingConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	Rules    []headerRule `json:"rules"`
+	Fallback string       `json:"fallback,omitempty"`
+}
+
+func parseHeaderRoutingConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	config := &headerRoutingConfig{Fallback: headerFallbackAll}
+	if err := json.Unmarshal(js, config); err != nil {
+		return nil, errors.Wrap(err, "grpc_discover: header routing config")
+	}
+	if config.Fallback != headerFallbackAll && config.Fallback != headerFallbackNone {
+		return nil, errors.Errorf("grpc_discover: header routing fallback %q must be %q or %q", config.Fallback, headerFallbackAll, headerFallbackNone)
+	}
+	for i, rule := range config.Rules {
+		if rule.Header == "" {
+			return nil, errors.New("grpc_discover: header routing rule without header")
+		}
+		if _, err := parseInstanceFilter(url.Values{rule.Match: {""}}); err != nil || rule.Match == "" {
+			return nil, errors.Errorf("grpc_discover: header routing rule %q: unknown match %q", rule.Header, rule.Match)
+		}
+		config.Rules[i].Header = strings.ToLower(rule.Header)
+	}
+	return config, nil
+}
+
+type headerRoutingPickerBuilder struct {
+	instances addressInstances
+
+	mu     sync.Mutex
+	config *headerRoutingConfig
+}
+
+func (b *headerRoutingPickerBuilder) setState(s balancer.ClientConnState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c, ok := s.BalancerConfig.(*headerRoutingConfig); ok {
+		b.config = c
+	}
+	b.instances.update(s.ResolverState)
+}
+
+func (b *headerRoutingPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	b.mu.Lock()
+	config := b.config
+	b.mu.Unlock()
+
+	p := &headerRoutingPicker{config: config, subConns: make([]routedSubConn, 0, len(info.ReadySCs))}
+	for sc, sci := range info.ReadySCs {
+		inst, _ := b.instances.lookup(sci.Address)
+		p.subConns = append(p.subConns, routedSubConn{sc: sc, inst: inst})
+	}
+	return p
+}
+
+type routedSubConn struct {
+	sc   balancer.SubConn
+	inst Instance
+}
+
+type headerRoutingPicker struct {
+	config   *headerRoutingConfig
+	subConns []routedSubConn
+}
+
+func (p *headerRoutingPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	query, filter, ok := p.filter(info)
+	if !ok {
+		return p.random(p.subConns), nil
+	}
+
+	matched := make([]routedSubConn, 0, len(p.subConns))
+	for _, s := range p.subConns {
+		if filter.match(s.inst) {
+			matched = append(matched, s)
+		}
+	}
+	if len(matched) > 0 {
+		return p.random(matched), nil
+	}
+	if p.config.Fallback == headerFallbackNone {
+		return balancer.PickResult{}, status.Errorf(codes.Unavailable, "grpc_discover: no instance matches %s", query.Encode())
+	}
+	return p.random(p.subConns), nil
+}
+
+// filter 由请求 metadata 中出现的规则 header 组成的过滤条件 (与 dial target 参数相同的形式),
+// 没有任何规则 header 时返回 false
+func (p *headerRoutingPicker) filter(info balancer.PickInfo) (url.Values, instanceFilter, bool) {
+	md, ok := metadata.FromOutgoingContext(info.Ctx)
+	if !ok {
+		return nil, instanceFilter{}, false
+	}
+
+	query := url.Values{}
+	for _, rule := range p.config.Rules {
+		if values := md.Get(rule.Header); len(values) > 0 && values[0] != "" {
+			query.Add(rule.Match, values[0])
+		}
+	}
+	if len(query) == 0 {
+		return nil, instanceFilter{}, false
+	}
+	filter, err := parseInstanceFilter(query)
+	return query, filter, err == nil
+}
+
+func (p *headerRoutingPicker) random(subConns []routedSubConn) balancer.PickResult {
+	return balancer.PickResult{SubConn: subConns[rand.Intn(len(subConns))].sc}
+}
@@ -0,0 +1,161 @@
+package grpc_discover
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// HealthRegistration 将 grpc health.Server 的状态与注册中心绑定
+type HealthRegistration struct {
+	plugin     GrpcDiscoverPluginInterface
+	logger     Logger
+	serverName string
+	address    string
+	opts       []RegisterOption
+
+	mu       sync.Mutex
+	serverID string
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// RegisterWithHealth 根据 hs 中 healthService 的状态注册/反注册 serverName,
+// healthService 为空表示整个 server 的状态
+func RegisterWithHealth(plugin GrpcDiscoverPluginInterface, hs *health.Server, healthService string, serverName string, address string, opts ...RegisterOption) (*HealthRegistration, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &HealthRegistration{
+		plugin:     plugin,
+		logger:     NopLogger{},
+		serverName: serverName,
+		address:    address,
+		opts:       opts,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	if p, ok := plugin.(interface{ pluginLogger() Logger }); ok {
+		h.logger = p.pluginLogger()
+	}
+
+	if _, ok := plugin.(*ConsulPlugin); ok {
+		// consul agent 直接检查 gRPC health 服务
+		close(h.done)
+		opts = append([]RegisterOption{WithGRPCCheck(healthService)}, opts...)
+		serverID, err := plugin.Register(serverName, address, opts...)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		h.serverID = serverID
+		return h, nil
+	}
+
+	resp, err := hs.Check(ctx, &healthpb.HealthCheckRequest{Service: healthService})
+	if err == nil && resp.Status == healthpb.HealthCheckResponse_SERVING {
+		if err := h.register(); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	stream := &healthWatchStream{ctx: ctx, updates: make(chan healthpb.HealthCheckResponse_ServingStatus, 1)}
+	go hs.Watch(&healthpb.HealthCheckRequest{Service: healthService}, stream)
+	go h.run(ctx, stream.updates)
+	return h, nil
+}
+
+// ServerID 当前注册的 serverID, 未注册时为空
+func (h *HealthRegistration) ServerID() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.serverID
+}
+
+// Stop 停止同步健康状态并反注册
+func (h *HealthRegistration) Stop() error {
+	h.cancel()
+	<-h.done
+	return h.unregister()
+}
+
+func (h *HealthRegistration) run(ctx context.Context, updates <-chan healthpb.HealthCheckResponse_ServingStatus) {
+	defer close(h.done)
+
+	var retry <-chan time.Time
+	serving := h.ServerID() != ""
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case status := <-updates:
+			serving = status == healthpb.HealthCheckResponse_SERVING
+		case <-retry:
+		}
+
+		retry = nil
+		var err error
+		if serving {
+			err = h.register()
+		} else {
+			err = h.unregister()
+		}
+		if err != nil {
+			h.logger.Error("health sync", fieldService(h.serverName), fieldAddress(h.address), fieldError(err))
+			retry = time.After(watchRetryInterval)
+		}
+	}
+}
+
+func (h *HealthRegistration) register() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.serverID != "" {
+		return nil
+	}
+
+	serverID, err := h.plugin.Register(h.serverName, h.address, h.opts...)
+	if err != nil {
+		return err
+	}
+	h.serverID = serverID
+	return nil
+}
+
+func (h *HealthRegistration) unregister() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.serverID == "" {
+		return nil
+	}
+
+	if err := h.plugin.UnRegister(h.serverID); err != nil {
+		return err
+	}
+	h.serverID = ""
+	return nil
+}
+
+// healthWatchStream 进程内调用 health.Server.Watch 用的 stream, 只实现 Context 和 Send
+type healthWatchStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	updates chan healthpb.HealthCheckResponse_ServingStatus
+}
+
+func (s *healthWatchStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *healthWatchStream) Send(resp *healthpb.HealthCheckResponse) error {
+	select {
+	case s.updates <- resp.Status:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
@@ -0,0 +1,182 @@
+package grpc_discover
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Instance 服务实例, a registered instance of a service
+type Instance struct {
+	ServerID    string
+	ServiceName string
+	Address     string
+
+	Version  string
+	Tags     []string
+	Metadata map[string]string
+
+	// Ports 通过 RegisterGroup 注册时实例的所有命名端口, 端口名 -> 地址
+	Ports map[string]string
+
+	Status InstanceStatus // 见 SetStatus
+
+	sig signature // 见 WithSigningKey
+}
+
+// Equal 判断 o 是否为相同的 Instance, 供 gRPC attributes 比较使用
+func (i Instance) Equal(o interface{}) bool {
+	oi, ok := o.(Instance)
+	return ok && reflect.DeepEqual(i, oi)
+}
+
+// instanceRecord etcd / redis 中存储的注册信息
+type instanceRecord struct {
+	Address  string            `json:"address"`
+	Version  string            `json:"version,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Ports    map[string]string `json:"ports,omitempty"`
+	Status   string            `json:"status,omitempty"`
+
+	KeyID     string `json:"key_id,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// encodeInstance 编码注册信息, 没有版本/标签/元数据/端口/状态/签名时只存地址, 兼容旧版本客户端
+func encodeInstance(inst Instance) string {
+	if inst.Version == "" && len(inst.Tags) == 0 && len(inst.Metadata) == 0 && len(inst.Ports) == 0 && inst.Status.stored() == "" && inst.sig.KeyID == "" {
+		return inst.Address
+	}
+
+	data, _ := json.Marshal(instanceRecord{
+		Address:   inst.Address,
+		Version:   inst.Version,
+		Tags:      inst.Tags,
+		Metadata:  inst.Metadata,
+		Ports:     inst.Ports,
+		Status:    inst.Status.stored(),
+		KeyID:     inst.sig.KeyID,
+		Signature: inst.sig.Value,
+	})
+	return string(data)
+}
+
+// decodeInstance 解码注册信息, 兼容只存地址的旧格式
+func decodeInstance(serverID string, serviceName string, value string) Instance {
+	inst := Instance{ServerID: serverID, ServiceName: serviceName, Address: value, Status: StatusServing}
+	if !strings.HasPrefix(value, "{") {
+		return inst
+	}
+
+	var record instanceRecord
+	if err := json.Unmarshal([]byte(value), &record); err != nil {
+		return inst
+	}
+	inst.Address = record.Address
+	inst.Version = record.Version
+	inst.Tags = record.Tags
+	inst.Metadata = record.Metadata
+	inst.Ports = record.Ports
+	inst.Status = parseStoredStatus(record.Status)
+	inst.sig = signature{KeyID: record.KeyID, Value: record.Signature}
+	return inst
+}
+
+// instanceSet 维护 watch 期间的实例集合, 只在集合变化时推送快照, 慢的消费者只会收到最新的快照
+type instanceSet struct {
+	accept    func(Instance) bool // 为 nil 时接受所有实例
+	instances map[string]Instance
+	ch        chan []Instance
+	last      []Instance
+	sent      bool
+}
+
+func newInstanceSet(accept func(Instance) bool) *instanceSet {
+	return &instanceSet{
+		accept:    accept,
+		instances: map[string]Instance{},
+		ch:        make(chan []Instance, 1),
+	}
+}
+
+func (s *instanceSet) put(inst Instance) {
+	if s.accept != nil && !s.accept(inst) {
+		delete(s.instances, inst.ServerID)
+		return
+	}
+	s.instances[inst.ServerID] = inst
+}
+
+func (s *instanceSet) delete(serverID string) {
+	delete(s.instances, serverID)
+}
+
+func (s *instanceSet) reset(list []Instance) {
+	s.instances = make(map[string]Instance, len(list))
+	for _, inst := range list {
+		s.put(inst)
+	}
+}
+
+// flush 集合发生变化 (或第一次调用) 时推送快照
+func (s *instanceSet) flush() {
+	snapshot := make([]Instance, 0, len(s.instances))
+	for _, inst := range s.instances {
+		snapshot = append(snapshot, inst)
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].ServerID < snapshot[j].ServerID })
+
+	if s.sent && instancesEqual(s.last, snapshot) {
+		return
+	}
+	s.last = snapshot
+	s.sent = true
+
+	select {
+	case <-s.ch:
+	default:
+	}
+	s.ch <- snapshot
+}
+
+func instancesEqual(a, b []Instance) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// watchConfig 内部 watch 参数
+type watchConfig struct {
+	// onError 查询注册中心失败时回调, watch 会自动重试
+	onError func(error)
+	// resolveNow 收到信号时重新全量拉取
+	resolveNow <-chan struct{}
+}
+
+// watchFunc 各插件的 watch 实现, ctx 结束时关闭返回的通道
+type watchFunc func(ctx context.Context, serviceName string, cfg watchConfig) <-chan []Instance
+
+// watchRetryInterval watch 出错后的重试间隔
+const watchRetryInterval = time.Second
+
+// sleepContext 等待 d, ctx 提前结束返回 false
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -1,15 +1,54 @@
 package grpc_discover
 
-import "google.golang.org/grpc/resolver"
+import (
+	"context"
+
+	"google.golang.org/grpc/resolver"
+)
 
 type GrpcDiscoverPluginInterface interface {
-	Register(serverName string, address string) (serverID string, err error)
+	Register(serverName string, address string, opts ...RegisterOption) (serverID string, err error)
 	UnRegister(serverID string) error
 	AutoUnRegister(serverID string)
 
+	// DiscoverByServerName / DiscoverByServerID 只返回 serving 的实例, 与 resolver 一致
 	DiscoverByServerName(serverName string) ([]string, error)
 	DiscoverByServerID(serverID string) (string, error)
 
+	// Context 版本, ctx 用于超时控制和链路追踪
+	RegisterContext(ctx context.Context, serverName string, address string, opts ...RegisterOption) (serverID string, err error)
+	UnRegisterContext(ctx context.Context, serverID string) error
+	DiscoverByServerNameContext(ctx context.Context, serverName string) ([]string, error)
+	DiscoverByServerIDContext(ctx context.Context, serverID string) (string, error)
+
+	// RegisterGroup 在同一个实例 ID 和心跳下注册多个服务及命名端口, UnRegisterGroup 一次反注册
+	RegisterGroup(ctx context.Context, group ServiceGroup, opts ...RegisterOption) (GroupRegistration, error)
+	UnRegisterGroup(ctx context.Context, groupID string) error
+
+	// Watch 监听服务实例变化, 每次变化推送全量快照, ctx 结束时关闭通道
+	Watch(ctx context.Context, serviceName string) (<-chan []Instance, error)
+
+	// SetServiceConfig 发布服务的 gRPC service config JSON, 为空时删除
+	SetServiceConfig(ctx context.Context, serviceName string, serviceConfig string) error
+
+	// SetTrafficSplit 发布服务的流量拆分规则, 为 nil 时删除
+	SetTrafficSplit(ctx context.Context, serviceName string, split *TrafficSplit) error
+
+	// SetStatus 修改本插件注册的实例的状态, 非 serving 的实例不再由 resolver 下发
+	SetStatus(ctx context.Context, serverID string, status InstanceStatus) error
+
+	// Namespaces 列出注册中心中存在实例的 namespace (见 WithNamespace), 默认 namespace 为 ""
+	Namespaces(ctx context.Context) ([]string, error)
+
+	// Close 按配置反注册本插件注册的实例, 停止心跳和 watch 并关闭客户端
+	Close(ctx context.Context) error
+
 	Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error)
 	Scheme() string
 }
+
+var (
+	_ GrpcDiscoverPluginInterface = (*ETCDPlugin)(nil)
+	_ GrpcDiscoverPluginInterface = (*ConsulPlugin)(nil)
+	_ GrpcDiscoverPluginInterface = (*RedisPlugin)(nil)
+)
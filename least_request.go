@@ -0,0 +1,135 @@
+package grpc_discover
+
+import (
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// LeastRequestBalancerName power-of-two-choices 最少未完成请求 balancer 的名称,
+// 通过 service config 启用:
+//
+//	{"loadBalancingConfig":[{"grpc_discover_least_request":{"choiceCount":2}}]}
+const LeastRequestBalancerName = "grpc_discover_least_request"
+
+// weightMetadataKey WithWeight 写入的 metadata key
+const weightMetadataKey = "weight"
+
+func init() {
+	balancer.Register(&discoverBalancerBuilder{
+		name:        LeastRequestBalancerName,
+		parseConfig: parseLeastRequestConfig,
+		newPicker: func() pickerBuilder {
+			return &leastRequestPickerBuilder{loads: newSubConnLoads(), config: defaultLeastRequestConfig()}
+		},
+	})
+}
+
+// WithWeight 注册实例的权重 (容量), 写入 metadata "weight", 供 least request balancer 使用
+func WithWeight(weight int) RegisterOption {
+	return WithMetadata(map[string]string{weightMetadataKey: strconv.Itoa(weight)})
+}
+
+type leastRequestConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	ChoiceCount int    `json:"choiceCount,omitempty"` // 每次随机比较的实例数, 默认 2
+	WeightKey   string `json:"weightKey,omitempty"`   // 权重的 metadata key, 默认 weight
+}
+
+func defaultLeastRequestConfig() *leastRequestConfig {
+	return &leastRequestConfig{ChoiceCount: 2, WeightKey: weightMetadataKey}
+}
+
+func parseLeastRequestConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	config := defaultLeastRequestConfig()
+	if err := json.Unmarshal(js, config); err != nil {
+		return nil, errors.Wrap(err, "grpc_discover: least request config")
+	}
+	if config.ChoiceCount < 2 {
+		return nil, errors.Errorf("grpc_discover: least request choiceCount %d must be at least 2", config.ChoiceCount)
+	}
+	return config, nil
+}
+
+type leastRequestPickerBuilder struct {
+	loads     *subConnLoads
+	instances addressInstances
+
+	mu     sync.Mutex
+	config *leastRequestConfig
+}
+
+func (b *leastRequestPickerBuilder) setState(s balancer.ClientConnState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c, ok := s.BalancerConfig.(*leastRequestConfig); ok {
+		b.config = c
+	}
+	b.instances.update(s.ResolverState)
+}
+
+func (b *leastRequestPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	b.mu.Lock()
+	config := b.config
+	b.mu.Unlock()
+
+	b.loads.sync(info.ReadySCs)
+	p := &leastRequestPicker{
+		config:   config,
+		loads:    b.loads,
+		subConns: make([]weightedSubConn, 0, len(info.ReadySCs)),
+	}
+	for sc, sci := range info.ReadySCs {
+		weight := 1.0
+		if inst, ok := b.instances.lookup(sci.Address); ok {
+			if w, err := strconv.ParseFloat(inst.Metadata[config.WeightKey], 64); err == nil && w > 0 {
+				weight = w
+			}
+		}
+		p.subConns = append(p.subConns, weightedSubConn{sc: sc, load: b.loads.get(sc), weight: weight})
+	}
+	return p
+}
+
+type weightedSubConn struct {
+	sc     balancer.SubConn
+	load   *int64
+	weight float64
+}
+
+// score 加上本次请求后每单位权重的未完成请求数
+func (w weightedSubConn) score() float64 {
+	return float64(atomic.LoadInt64(w.load)+1) / w.weight
+}
+
+type leastRequestPicker struct {
+	config   *leastRequestConfig
+	loads    *subConnLoads
+	subConns []weightedSubConn
+}
+
+func (p *leastRequestPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	best := p.subConns[rand.Intn(len(p.subConns))]
+	if len(p.subConns) > 1 {
+		bestScore := best.score()
+		for i := 1; i < p.config.ChoiceCount; i++ {
+			c := p.subConns[rand.Intn(len(p.subConns))]
+			if score := c.score(); score < bestScore {
+				best, bestScore = c, score
+			}
+		}
+	}
+	return balancer.PickResult{SubConn: best.sc, Done: p.loads.start(best.load)}, nil
+}
@@ -0,0 +1,121 @@
+package grpc_discover
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Level 日志级别，log level
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+}
+
+// Field 结构化日志字段，structured log field
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Any 构造任意字段
+func Any(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+func fieldBackend(backend string) Field   { return Field{Key: "backend", Value: backend} }
+func fieldService(service string) Field   { return Field{Key: "service", Value: service} }
+func fieldServerID(serverID string) Field { return Field{Key: "serverID", Value: serverID} }
+func fieldAddress(address string) Field   { return Field{Key: "address", Value: address} }
+func fieldTarget(target string) Field     { return Field{Key: "target", Value: target} }
+func fieldError(err error) Field          { return Field{Key: "error", Value: err} }
+
+// Logger 插件日志接口, 可以适配 zap / slog 等
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+// NopLogger 丢弃所有日志, 默认 Logger
+type NopLogger struct{}
+
+func (NopLogger) Debug(string, ...Field) {}
+func (NopLogger) Info(string, ...Field)  {}
+func (NopLogger) Warn(string, ...Field)  {}
+func (NopLogger) Error(string, ...Field) {}
+
+// NewStdLogger 使用标准库 log 输出, 低于 level 的日志会被丢弃
+func NewStdLogger(l *log.Logger, level Level) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return &stdLogger{l: l, level: level}
+}
+
+type stdLogger struct {
+	l     *log.Logger
+	level Level
+}
+
+func (s *stdLogger) Debug(msg string, fields ...Field) { s.output(LevelDebug, msg, fields) }
+func (s *stdLogger) Info(msg string, fields ...Field)  { s.output(LevelInfo, msg, fields) }
+func (s *stdLogger) Warn(msg string, fields ...Field)  { s.output(LevelWarn, msg, fields) }
+func (s *stdLogger) Error(msg string, fields ...Field) { s.output(LevelError, msg, fields) }
+
+func (s *stdLogger) output(level Level, msg string, fields []Field) {
+	if level < s.level {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[GRPC Discover][%s] %s", level, msg)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+	s.l.Output(3, b.String())
+}
+
+// withFields 给所有日志附加固定字段
+func withFields(l Logger, fields ...Field) Logger {
+	if _, ok := l.(NopLogger); ok {
+		return l
+	}
+	return &fieldLogger{l: l, fields: fields}
+}
+
+type fieldLogger struct {
+	l      Logger
+	fields []Field
+}
+
+func (f *fieldLogger) Debug(msg string, fields ...Field) { f.l.Debug(msg, f.merge(fields)...) }
+func (f *fieldLogger) Info(msg string, fields ...Field)  { f.l.Info(msg, f.merge(fields)...) }
+func (f *fieldLogger) Warn(msg string, fields ...Field)  { f.l.Warn(msg, f.merge(fields)...) }
+func (f *fieldLogger) Error(msg string, fields ...Field) { f.l.Error(msg, f.merge(fields)...) }
+
+func (f *fieldLogger) merge(fields []Field) []Field {
+	out := make([]Field, 0, len(f.fields)+len(fields))
+	out = append(out, f.fields...)
+	return append(out, fields...)
+}
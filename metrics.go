@@ -0,0 +1,192 @@
+package grpc_discover
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics Prometheus 指标, 只有通过 WithMetrics 开启时才会注册
+type metrics struct {
+	registrations     *prometheus.GaugeVec
+	heartbeatFailures *prometheus.CounterVec
+	resolveDuration   *prometheus.HistogramVec
+	resolveErrors     *prometheus.CounterVec
+	addresses         *prometheus.GaugeVec
+	lastUpdate        *prometheus.GaugeVec
+	outlierEjections  *prometheus.CounterVec
+	outlierEjected    *prometheus.GaugeVec
+}
+
+var metricLabels = []string{"backend", "service"}
+
+// WithMetrics 将插件指标注册到 reg, 不会触碰全局 registry
+func WithMetrics(reg prometheus.Registerer) Option {
+	return func(o *options) {
+		o.registerer = reg
+	}
+}
+
+func newMetrics(reg prometheus.Registerer) (*metrics, error) {
+	if reg == nil {
+		return nil, nil
+	}
+
+	m := &metrics{
+		registrations: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "grpc_discover",
+			Name:      "registrations_active",
+			Help:      "Number of instances currently registered by this process.",
+		}, metricLabels),
+		heartbeatFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "grpc_discover",
+			Name:      "heartbeat_failures_total",
+			Help:      "Number of failed heartbeats or lost keepalives.",
+		}, metricLabels),
+		resolveDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "grpc_discover",
+			Name:      "resolve_duration_seconds",
+			Help:      "Latency of resolver lookups against the registry.",
+			Buckets:   prometheus.DefBuckets,
+		}, metricLabels),
+		resolveErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "grpc_discover",
+			Name:      "resolve_errors_total",
+			Help:      "Number of failed resolver lookups.",
+		}, metricLabels),
+		addresses: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "grpc_discover",
+			Name:      "resolver_addresses",
+			Help:      "Number of addresses in the last resolver update.",
+		}, metricLabels),
+		lastUpdate: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "grpc_discover",
+			Name:      "resolver_last_update_timestamp_seconds",
+			Help:      "Unix time of the last successful resolver update.",
+		}, metricLabels),
+		outlierEjections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "grpc_discover",
+			Name:      "outlier_ejections_total",
+			Help:      "Number of addresses ejected by client-side outlier detection.",
+		}, metricLabels),
+		outlierEjected: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "grpc_discover",
+			Name:      "outlier_ejected_addresses",
+			Help:      "Number of addresses currently ejected by outlier detection.",
+		}, metricLabels),
+	}
+
+	var err error
+	m.registrations = register(reg, m.registrations, &err)
+	m.heartbeatFailures = register(reg, m.heartbeatFailures, &err)
+	m.resolveDuration = register(reg, m.resolveDuration, &err)
+	m.resolveErrors = register(reg, m.resolveErrors, &err)
+	m.addresses = register(reg, m.addresses, &err)
+	m.lastUpdate = register(reg, m.lastUpdate, &err)
+	m.outlierEjections = register(reg, m.outlierEjections, &err)
+	m.outlierEjected = register(reg, m.outlierEjected, &err)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// register 注册 collector, 已经注册过则复用已有的
+func register[T prometheus.Collector](reg prometheus.Registerer, c T, errp *error) T {
+	if *errp != nil {
+		return c
+	}
+
+	err := reg.Register(c)
+	if err == nil {
+		return c
+	}
+
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(T); ok {
+			return existing
+		}
+	}
+	*errp = err
+	return c
+}
+
+// backend 绑定 backend 标签, nil 安全
+func (m *metrics) backend(name string) *backendMetrics {
+	if m == nil {
+		return nil
+	}
+	return &backendMetrics{m: m, backend: name}
+}
+
+type backendMetrics struct {
+	m       *metrics
+	backend string
+}
+
+func (b *backendMetrics) registered(service string) {
+	if b == nil {
+		return
+	}
+	b.m.registrations.WithLabelValues(b.backend, service).Inc()
+}
+
+func (b *backendMetrics) unregistered(service string) {
+	if b == nil {
+		return
+	}
+	b.m.registrations.WithLabelValues(b.backend, service).Dec()
+}
+
+func (b *backendMetrics) heartbeatFailed(service string) {
+	if b == nil {
+		return
+	}
+	b.m.heartbeatFailures.WithLabelValues(b.backend, service).Inc()
+}
+
+// resolved 记录一次注册中心查询的耗时和结果
+func (b *backendMetrics) resolved(service string, start time.Time, err error) {
+	if b == nil {
+		return
+	}
+	b.m.resolveDuration.WithLabelValues(b.backend, service).Observe(time.Since(start).Seconds())
+	if err != nil {
+		b.m.resolveErrors.WithLabelValues(b.backend, service).Inc()
+	}
+}
+
+// resolveFailed 记录一次没有查询耗时的解析失败, 例如 UpdateState 失败
+func (b *backendMetrics) resolveFailed(service string) {
+	if b == nil {
+		return
+	}
+	b.m.resolveErrors.WithLabelValues(b.backend, service).Inc()
+}
+
+// updated 记录一次成功推送给 gRPC 的地址更新
+func (b *backendMetrics) updated(service string, n int) {
+	if b == nil {
+		return
+	}
+	b.m.addresses.WithLabelValues(b.backend, service).Set(float64(n))
+	b.m.lastUpdate.WithLabelValues(b.backend, service).SetToCurrentTime()
+}
+
+// outlierEjected 记录一次 outlier detection 摘除
+func (b *backendMetrics) outlierEjected(service string) {
+	if b == nil {
+		return
+	}
+	b.m.outlierEjections.WithLabelValues(b.backend, service).Inc()
+	b.m.outlierEjected.WithLabelValues(b.backend, service).Inc()
+}
+
+func (b *backendMetrics) outlierRestored(service string) {
+	if b == nil {
+		return
+	}
+	b.m.outlierEjected.WithLabelValues(b.backend, service).Dec()
+}
@@ -0,0 +1,147 @@
+package grpc_discover
+
+import (
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Option 插件可选配置, optional plugin configuration
+type Option func(*options)
+
+type options struct {
+	logger         Logger
+	registerer     prometheus.Registerer
+	tracerProvider trace.TracerProvider
+
+	consulQuery *consulapi.QueryOptions
+	authorities map[string]AuthorityConfig
+
+	unregisterOnClose bool
+	legacyServerIDs   bool
+	namespace         string
+	tls               *TLSConfig
+	signingKey        *SigningKey
+	trustedKeys       map[string]SigningKey
+
+	outlierListener func(OutlierEvent)
+	drainTimeout    time.Duration
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		logger:            NopLogger{},
+		unregisterOnClose: true,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithLogger 设置插件日志, 默认不输出任何日志
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		if logger == nil {
+			logger = NopLogger{}
+		}
+		o.logger = logger
+	}
+}
+
+// WithUnregisterOnClose Close 时是否反注册本插件注册的实例, 默认为 true.
+// 关闭后不反注册的实例在心跳停止后由注册中心按 TTL 过期删除
+func WithUnregisterOnClose(unregister bool) Option {
+	return func(o *options) {
+		o.unregisterOnClose = unregister
+	}
+}
+
+// WithNamespace 插件使用的 namespace (例如环境或租户), 注册、发现和 watch 都只在该
+// namespace 内进行, 共用同一个注册中心的 staging 和 prod 互不可见. 默认为空
+func WithNamespace(namespace string) Option {
+	return func(o *options) {
+		o.namespace = namespace
+	}
+}
+
+// WithLegacyServerIDs 迁移期间兼容旧的 grpc-discover-<name>-<xid> 格式:
+// 注册仍使用旧格式, 发现和 watch 同时读取新旧两种格式. 旧格式没有 namespace,
+// 因此与 WithNamespace 同时使用时不生效. 迁移步骤见 README
+func WithLegacyServerIDs() Option {
+	return func(o *options) {
+		o.legacyServerIDs = true
+	}
+}
+
+// RegisterOption 单次注册的可选配置, per-registration configuration
+type RegisterOption func(*registerOptions)
+
+type registerOptions struct {
+	instanceID string
+
+	version  string
+	tags     []string
+	metadata map[string]string
+
+	check  consulCheck
+	consul consulScope
+}
+
+func newRegisterOptions(opts []RegisterOption) registerOptions {
+	var o registerOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithInstanceID 使用调用方提供的稳定实例 ID (例如 pod 名称或 host:port) 生成 serverID.
+// 相同 ID 再次注册时原子地覆盖旧的注册信息, 重启后不会残留过期实例
+func WithInstanceID(instanceID string) RegisterOption {
+	return func(o *registerOptions) {
+		o.instanceID = instanceID
+	}
+}
+
+// WithVersion 注册实例的版本, 可通过 dial target 的 version 参数过滤
+func WithVersion(version string) RegisterOption {
+	return func(o *registerOptions) {
+		o.version = version
+	}
+}
+
+// WithTags 注册实例的标签, 可通过 dial target 的 tag 参数过滤
+func WithTags(tags ...string) RegisterOption {
+	return func(o *registerOptions) {
+		o.tags = append(o.tags, tags...)
+	}
+}
+
+// WithMetadata 注册实例的元数据, 可通过 dial target 的 meta.<key> 参数过滤,
+// 其中 "zone" 也可以用 zone 参数过滤. consul 不接受 "version" 和 grpc_discover_ 开头的 key
+func WithMetadata(metadata map[string]string) RegisterOption {
+	return func(o *registerOptions) {
+		if o.metadata == nil {
+			o.metadata = map[string]string{}
+		}
+		for k, v := range metadata {
+			o.metadata[k] = v
+		}
+	}
+}
+
+// instance 根据注册参数构造 Instance
+func (o registerOptions) instance(serverID string, serverName string, address string) Instance {
+	return Instance{
+		ServerID:    serverID,
+		ServiceName: serverName,
+		Address:     address,
+		Version:     o.version,
+		Tags:        o.tags,
+		Metadata:    o.metadata,
+		Status:      StatusServing,
+	}
+}
@@ -0,0 +1,609 @@
+package grpc_discover
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/roundrobin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
+)
+
+// OutlierDetectionBalancerName 客户端异常实例摘除 balancer 的名称, 包裹 childPolicy
+// (默认 round_robin), 通过 service config 启用:
+//
+//	{"loadBalancingConfig":[{"grpc_discover_outlier_detection":{
+//		"failureRateThreshold":0.5,"childPolicy":[{"round_robin":{}}]}}]}
+const OutlierDetectionBalancerName = "grpc_discover_outlier_detection"
+
+func init() {
+	balancer.Register(outlierBuilder{})
+}
+
+// OutlierEvent 地址被摘除或恢复时的事件
+type OutlierEvent struct {
+	Service  string
+	Address  string
+	ServerID string
+	Ejected  bool          // true 摘除, false 恢复
+	Reason   string        // 摘除原因
+	Duration time.Duration // 本次摘除时长
+}
+
+// WithOutlierListener 接收本插件 resolver 下 outlier detection balancer 的摘除 / 恢复事件
+func WithOutlierListener(listener func(OutlierEvent)) Option {
+	return func(o *options) {
+		o.outlierListener = listener
+	}
+}
+
+// failureCodes 计为实例故障的状态码, 业务错误 (NotFound 等) 不计入
+var failureCodes = map[codes.Code]bool{
+	codes.Unknown:          true,
+	codes.DeadlineExceeded: true,
+	codes.Internal:         true,
+	codes.Unavailable:      true,
+	codes.DataLoss:         true,
+}
+
+var errEjected = errors.New("grpc_discover: address ejected by outlier detection")
+
+// jsonDuration service config 中的时长, 例如 "10s"
+type jsonDuration time.Duration
+
+func (d *jsonDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(v)
+	return nil
+}
+
+type outlierConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	Interval           jsonDuration `json:"interval,omitempty"`           // 默认 10s
+	BaseEjectionTime   jsonDuration `json:"baseEjectionTime,omitempty"`   // 默认 30s
+	MaxEjectionTime    jsonDuration `json:"maxEjectionTime,omitempty"`    // 默认 300s
+	MaxEjectionPercent int          `json:"maxEjectionPercent,omitempty"` // 默认 10
+
+	MinimumRequests      int     `json:"minimumRequests,omitempty"`      // 一个周期内参与判断的最少请求数, 默认 10
+	FailureRateThreshold float64 `json:"failureRateThreshold,omitempty"` // 默认 0.5
+	LatencyFactor        float64 `json:"latencyFactor,omitempty"`        // 默认 3, 为 0 时不按延迟摘除
+	MinimumHosts         int     `json:"minimumHosts,omitempty"`         // 按延迟摘除所需的最少地址数, 默认 3
+
+	ChildPolicy []map[string]json.RawMessage `json:"childPolicy,omitempty"`
+
+	child       balancer.Builder
+	childConfig serviceconfig.LoadBalancingConfig
+}
+
+func defaultOutlierConfig() *outlierConfig {
+	return &outlierConfig{
+		Interval:             jsonDuration(10 * time.Second),
+		BaseEjectionTime:     jsonDuration(30 * time.Second),
+		MaxEjectionTime:      jsonDuration(300 * time.Second),
+		MaxEjectionPercent:   10,
+		MinimumRequests:      10,
+		FailureRateThreshold: 0.5,
+		LatencyFactor:        3,
+		MinimumHosts:         3,
+		child:                balancer.Get(roundrobin.Name),
+	}
+}
+
+// ejectionTime 第 n 次连续摘除的时长
+func (c *outlierConfig) ejectionTime(n int) time.Duration {
+	d := time.Duration(c.BaseEjectionTime)
+	max := time.Duration(c.MaxEjectionTime)
+	if max < d {
+		max = d
+	}
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+type outlierBuilder struct{}
+
+func (outlierBuilder) Name() string {
+	return OutlierDetectionBalancerName
+}
+
+func (outlierBuilder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	config := defaultOutlierConfig()
+	if err := json.Unmarshal(js, config); err != nil {
+		return nil, errors.Wrap(err, "grpc_discover: outlier detection config")
+	}
+	if config.Interval <= 0 || config.BaseEjectionTime <= 0 {
+		return nil, errors.New("grpc_discover: outlier detection interval and baseEjectionTime must be positive")
+	}
+	if config.MaxEjectionPercent < 0 || config.MaxEjectionPercent > 100 {
+		return nil, errors.Errorf("grpc_discover: outlier detection maxEjectionPercent %d out of range", config.MaxEjectionPercent)
+	}
+
+	// 与 gRPC 一致, 使用 childPolicy 中第一个已注册的策略
+	for _, policy := range config.ChildPolicy {
+		for name, raw := range policy {
+			builder := balancer.Get(name)
+			if builder == nil {
+				continue
+			}
+			config.child = builder
+			if parser, ok := builder.(balancer.ConfigParser); ok {
+				childConfig, err := parser.ParseConfig(raw)
+				if err != nil {
+					return nil, errors.Wrapf(err, "grpc_discover: outlier detection child policy %s", name)
+				}
+				config.childConfig = childConfig
+			}
+			return config, nil
+		}
+	}
+	if len(config.ChildPolicy) > 0 {
+		return nil, errors.New("grpc_discover: outlier detection has no registered child policy")
+	}
+	return config, nil
+}
+
+func (outlierBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	b := &outlierBalancer{
+		cc:       cc,
+		opts:     opts,
+		info:     resolverInfo{base: &pluginBase{logger: NopLogger{}}},
+		config:   defaultOutlierConfig(),
+		subConns: map[balancer.SubConn]*outlierSubConn{},
+		addrs:    map[string]*outlierAddr{},
+	}
+	b.timer = time.AfterFunc(time.Duration(b.config.Interval), b.tick)
+	return b
+}
+
+// outlierBalancer 子策略的所有调用都在 childMu 下进行, 定时检查和 gRPC 的回调互斥
+type outlierBalancer struct {
+	cc   balancer.ClientConn
+	opts balancer.BuildOptions
+
+	childMu   sync.Mutex
+	child     balancer.Balancer
+	childName string
+	info      resolverInfo
+	config    *outlierConfig
+	timer     *time.Timer
+	closed    bool
+
+	mu       sync.Mutex
+	subConns map[balancer.SubConn]*outlierSubConn // key 为父 ClientConn 创建的 SubConn
+	addrs    map[string]*outlierAddr
+}
+
+// outlierAddr 一个地址的统计和摘除状态
+type outlierAddr struct {
+	serverID string
+	present  bool // 在最近一次 resolver 结果中
+
+	requests  int64 // 本周期, 原子操作
+	failures  int64
+	latencyNS int64
+
+	ejected   bool
+	ejectedAt time.Time
+	ejections int // 连续摘除次数, 决定摘除时长
+	subConns  map[*outlierSubConn]struct{}
+}
+
+// outlierSubConn 交给子策略的 SubConn, 摘除时向子策略报告 TRANSIENT_FAILURE
+type outlierSubConn struct {
+	balancer.SubConn
+	addr  string
+	state balancer.SubConnState // 最近一次真实状态
+}
+
+func (b *outlierBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	b.childMu.Lock()
+	defer b.childMu.Unlock()
+
+	if config, ok := s.BalancerConfig.(*outlierConfig); ok {
+		if config.Interval != b.config.Interval {
+			b.timer.Reset(time.Duration(config.Interval))
+		}
+		b.config = config
+	}
+	if info, ok := resolverInfoFrom(s.ResolverState); ok {
+		b.info = info
+	}
+
+	present := map[string]resolver.Address{}
+	for _, addr := range s.ResolverState.Addresses {
+		present[addr.Addr] = addr
+	}
+	b.mu.Lock()
+	for addr, a := range b.addrs {
+		a.present = false
+		if _, ok := present[addr]; !ok && len(a.subConns) == 0 {
+			delete(b.addrs, addr)
+		}
+	}
+	for addr, ra := range present {
+		a := b.addrLocked(addr)
+		a.present = true
+		if inst, ok := InstanceFromAddress(ra); ok {
+			a.serverID = inst.ServerID
+		}
+	}
+	b.mu.Unlock()
+
+	if b.child == nil || b.childName != b.config.child.Name() {
+		b.switchChild()
+	}
+	return b.child.UpdateClientConnState(balancer.ClientConnState{
+		ResolverState:  s.ResolverState,
+		BalancerConfig: b.config.childConfig,
+	})
+}
+
+// switchChild 子策略变化时关闭旧的子策略并移除它创建的 SubConn
+func (b *outlierBalancer) switchChild() {
+	if b.child != nil {
+		b.child.Close()
+		b.mu.Lock()
+		for sc, osc := range b.subConns {
+			b.removeLocked(sc, osc)
+			b.cc.RemoveSubConn(sc)
+		}
+		b.mu.Unlock()
+	}
+	b.childName = b.config.child.Name()
+	b.child = b.config.child.Build(&outlierClientConn{ClientConn: b.cc, b: b}, b.opts)
+}
+
+func (b *outlierBalancer) addrLocked(addr string) *outlierAddr {
+	a, ok := b.addrs[addr]
+	if !ok {
+		a = &outlierAddr{subConns: map[*outlierSubConn]struct{}{}}
+		b.addrs[addr] = a
+	}
+	return a
+}
+
+func (b *outlierBalancer) removeLocked(sc balancer.SubConn, osc *outlierSubConn) {
+	delete(b.subConns, sc)
+	if a, ok := b.addrs[osc.addr]; ok {
+		delete(a.subConns, osc)
+	}
+}
+
+func (b *outlierBalancer) ResolverError(err error) {
+	b.childMu.Lock()
+	defer b.childMu.Unlock()
+	if b.child != nil {
+		b.child.ResolverError(err)
+	}
+}
+
+func (b *outlierBalancer) UpdateSubConnState(sc balancer.SubConn, state balancer.SubConnState) {
+	b.childMu.Lock()
+	defer b.childMu.Unlock()
+
+	b.mu.Lock()
+	osc, ok := b.subConns[sc]
+	if !ok {
+		b.mu.Unlock()
+		return
+	}
+	osc.state = state
+	ejected := b.addrs[osc.addr] != nil && b.addrs[osc.addr].ejected
+	if state.ConnectivityState == connectivity.Shutdown {
+		b.removeLocked(sc, osc)
+	}
+	b.mu.Unlock()
+
+	if ejected && state.ConnectivityState != connectivity.Shutdown {
+		state = balancer.SubConnState{ConnectivityState: connectivity.TransientFailure, ConnectionError: errEjected}
+	}
+	if b.child != nil {
+		b.child.UpdateSubConnState(osc, state)
+	}
+}
+
+func (b *outlierBalancer) Close() {
+	b.childMu.Lock()
+	defer b.childMu.Unlock()
+
+	b.closed = true
+	b.timer.Stop()
+	b.mu.Lock()
+	for _, a := range b.addrs {
+		if a.ejected {
+			b.info.base.metrics.outlierRestored(b.info.service)
+		}
+	}
+	b.mu.Unlock()
+	if b.child != nil {
+		b.child.Close()
+	}
+}
+
+func (b *outlierBalancer) ExitIdle() {
+	b.childMu.Lock()
+	defer b.childMu.Unlock()
+	if ei, ok := b.child.(balancer.ExitIdler); ok {
+		ei.ExitIdle()
+	}
+}
+
+// tick 每个周期检查一次, 事件在释放 childMu 后发出, listener 可以回调 balancer
+func (b *outlierBalancer) tick() {
+	info, events := b.check()
+	for _, event := range events {
+		emitOutlierEvent(info, event)
+	}
+}
+
+// check 恢复到期的地址并摘除异常地址, 返回需要发出的事件
+func (b *outlierBalancer) check() (resolverInfo, []OutlierEvent) {
+	b.childMu.Lock()
+	defer b.childMu.Unlock()
+	if b.closed {
+		return b.info, nil
+	}
+	defer b.timer.Reset(time.Duration(b.config.Interval))
+
+	type sample struct {
+		addr     string
+		a        *outlierAddr
+		requests int64
+		failures int64
+		latency  time.Duration
+	}
+
+	now := time.Now()
+	var events []OutlierEvent
+	var states []func()
+
+	b.mu.Lock()
+	samples := make([]sample, 0, len(b.addrs))
+	ejected, total := 0, 0
+	for addr, a := range b.addrs {
+		if !a.present {
+			// 已从注册中心删除的地址不再计入
+			if a.ejected {
+				a.ejected = false
+				events = append(events, OutlierEvent{Address: addr, ServerID: a.serverID})
+			}
+			if len(a.subConns) == 0 {
+				delete(b.addrs, addr)
+			}
+			continue
+		}
+		total++
+		s := sample{
+			addr:     addr,
+			a:        a,
+			requests: atomic.SwapInt64(&a.requests, 0),
+			failures: atomic.SwapInt64(&a.failures, 0),
+		}
+		if latency := atomic.SwapInt64(&a.latencyNS, 0); s.requests > 0 {
+			s.latency = time.Duration(latency / s.requests)
+		}
+
+		if a.ejected && now.Sub(a.ejectedAt) >= b.config.ejectionTime(a.ejections) {
+			a.ejected = false
+			events = append(events, OutlierEvent{Address: addr, ServerID: a.serverID})
+			states = append(states, b.notifyLocked(a))
+		}
+		if a.ejected {
+			ejected++
+			continue
+		}
+		samples = append(samples, s)
+	}
+
+	// 延迟基准: 请求数足够的地址的平均延迟的中位数
+	var median time.Duration
+	if b.config.LatencyFactor > 0 {
+		var latencies []time.Duration
+		for _, s := range samples {
+			if s.requests >= int64(b.config.MinimumRequests) {
+				latencies = append(latencies, s.latency)
+			}
+		}
+		if len(latencies) >= b.config.MinimumHosts && len(latencies) > 0 {
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			median = latencies[len(latencies)/2]
+		}
+	}
+
+	// 故障率高的先摘除
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].failures*samples[j].requests > samples[j].failures*samples[i].requests
+	})
+	for _, s := range samples {
+		reason := ""
+		if s.requests >= int64(b.config.MinimumRequests) {
+			if float64(s.failures) >= b.config.FailureRateThreshold*float64(s.requests) {
+				reason = "failure rate"
+			} else if median > 0 && float64(s.latency) > b.config.LatencyFactor*float64(median) {
+				reason = "latency"
+			}
+		}
+		if reason == "" {
+			// 有足够请求且表现正常的周期才减少连续摘除次数
+			if s.a.ejections > 0 && s.requests >= int64(b.config.MinimumRequests) {
+				s.a.ejections--
+			}
+			continue
+		}
+		if ejected*100 >= b.config.MaxEjectionPercent*total {
+			continue
+		}
+
+		ejected++
+		s.a.ejected = true
+		s.a.ejectedAt = now
+		s.a.ejections++
+		events = append(events, OutlierEvent{
+			Address:  s.addr,
+			ServerID: s.a.serverID,
+			Ejected:  true,
+			Reason:   reason,
+			Duration: b.config.ejectionTime(s.a.ejections),
+		})
+		states = append(states, b.notifyLocked(s.a))
+	}
+	b.mu.Unlock()
+
+	for _, notify := range states {
+		notify()
+	}
+	return b.info, events
+}
+
+// notifyLocked 返回向子策略报告 a 的 SubConn 状态的函数, 在释放 b.mu 后调用
+func (b *outlierBalancer) notifyLocked(a *outlierAddr) func() {
+	type update struct {
+		sc    *outlierSubConn
+		state balancer.SubConnState
+	}
+	updates := make([]update, 0, len(a.subConns))
+	for osc := range a.subConns {
+		state := osc.state
+		if a.ejected {
+			state = balancer.SubConnState{ConnectivityState: connectivity.TransientFailure, ConnectionError: errEjected}
+		}
+		updates = append(updates, update{osc, state})
+	}
+	return func() {
+		if b.child == nil {
+			return
+		}
+		for _, u := range updates {
+			b.child.UpdateSubConnState(u.sc, u.state)
+		}
+	}
+}
+
+func emitOutlierEvent(info resolverInfo, event OutlierEvent) {
+	base := info.base
+	event.Service = info.service
+
+	fields := []Field{fieldService(event.Service), fieldAddress(event.Address), fieldServerID(event.ServerID)}
+	if event.Ejected {
+		base.logger.Warn("outlier ejected", append(fields, Any("reason", event.Reason), Any("duration", event.Duration))...)
+		base.metrics.outlierEjected(event.Service)
+	} else {
+		base.logger.Info("outlier restored", fields...)
+		base.metrics.outlierRestored(event.Service)
+	}
+	if listener := base.opt.outlierListener; listener != nil {
+		listener(event)
+	}
+}
+
+// record 记录一次请求的结果
+func (b *outlierBalancer) record(addr string, start time.Time, err error) {
+	b.mu.Lock()
+	a, ok := b.addrs[addr]
+	b.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	atomic.AddInt64(&a.requests, 1)
+	atomic.AddInt64(&a.latencyNS, int64(time.Since(start)))
+	if err != nil && failureCodes[status.Code(err)] {
+		atomic.AddInt64(&a.failures, 1)
+	}
+}
+
+// outlierClientConn 子策略看到的 ClientConn
+type outlierClientConn struct {
+	balancer.ClientConn
+	b *outlierBalancer
+}
+
+func (cc *outlierClientConn) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	sc, err := cc.ClientConn.NewSubConn(addrs, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	osc := &outlierSubConn{SubConn: sc, state: balancer.SubConnState{ConnectivityState: connectivity.Idle}}
+	if len(addrs) > 0 {
+		osc.addr = addrs[0].Addr
+	}
+	b := cc.b
+	b.mu.Lock()
+	b.subConns[sc] = osc
+	b.addrLocked(osc.addr).subConns[osc] = struct{}{}
+	b.mu.Unlock()
+	return osc, nil
+}
+
+func (cc *outlierClientConn) RemoveSubConn(sc balancer.SubConn) {
+	osc, ok := sc.(*outlierSubConn)
+	if !ok {
+		return
+	}
+	cc.ClientConn.RemoveSubConn(osc.SubConn)
+}
+
+func (cc *outlierClientConn) UpdateAddresses(sc balancer.SubConn, addrs []resolver.Address) {
+	osc, ok := sc.(*outlierSubConn)
+	if !ok {
+		return
+	}
+	cc.ClientConn.UpdateAddresses(osc.SubConn, addrs)
+}
+
+func (cc *outlierClientConn) UpdateState(state balancer.State) {
+	if state.Picker != nil {
+		state.Picker = &outlierPicker{picker: state.Picker, b: cc.b}
+	}
+	cc.ClientConn.UpdateState(state)
+}
+
+// outlierPicker 将子策略选出的 SubConn 还原为父 ClientConn 的 SubConn 并统计结果
+type outlierPicker struct {
+	picker balancer.Picker
+	b      *outlierBalancer
+}
+
+func (p *outlierPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	result, err := p.picker.Pick(info)
+	if err != nil {
+		return result, err
+	}
+	osc, ok := result.SubConn.(*outlierSubConn)
+	if !ok {
+		return result, nil
+	}
+
+	start := time.Now()
+	done := result.Done
+	result.SubConn = osc.SubConn
+	result.Done = func(di balancer.DoneInfo) {
+		p.b.record(osc.addr, start, di.Err)
+		if done != nil {
+			done(di)
+		}
+	}
+	return result, nil
+}
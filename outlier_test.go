@@ -0,0 +1,290 @@
+package grpc_discover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+func (*fakeSubConn) Connect() {}
+
+func (*fakeSubConn) UpdateAddresses([]resolver.Address) {}
+
+// fakeBalancerClientConn 记录创建的 SubConn 和最近一次的 picker
+type fakeBalancerClientConn struct {
+	balancer.ClientConn
+
+	mu       sync.Mutex
+	subConns []*fakeSubConn
+	picker   balancer.Picker
+}
+
+func (cc *fakeBalancerClientConn) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	sc := &fakeSubConn{name: addrs[0].Addr}
+	cc.subConns = append(cc.subConns, sc)
+	return sc, nil
+}
+
+func (cc *fakeBalancerClientConn) RemoveSubConn(balancer.SubConn) {}
+
+func (cc *fakeBalancerClientConn) UpdateAddresses(balancer.SubConn, []resolver.Address) {}
+
+func (cc *fakeBalancerClientConn) UpdateState(state balancer.State) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.picker = state.Picker
+}
+
+func (cc *fakeBalancerClientConn) ResolveNow(resolver.ResolveNowOptions) {}
+
+type outlierTest struct {
+	t      *testing.T
+	b      *outlierBalancer
+	cc     *fakeBalancerClientConn
+	addrs  []string
+	mu     sync.Mutex
+	events []OutlierEvent
+}
+
+// newOutlierTest 用 round_robin 子策略创建 outlier balancer, n 个地址都已 READY.
+// 测试直接调用 tick, 不等待定时器
+func newOutlierTest(t *testing.T, n int, config string, listener func(*outlierTest, OutlierEvent)) *outlierTest {
+	t.Helper()
+	ot := &outlierTest{t: t, cc: &fakeBalancerClientConn{}}
+	base, err := newPluginBase("fake", []Option{WithOutlierListener(func(event OutlierEvent) {
+		ot.mu.Lock()
+		ot.events = append(ot.events, event)
+		ot.mu.Unlock()
+		if listener != nil {
+			listener(ot, event)
+		}
+	})})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lbConfig, err := outlierBuilder{}.ParseConfig(json.RawMessage(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ot.b = outlierBuilder{}.Build(ot.cc, balancer.BuildOptions{}).(*outlierBalancer)
+	t.Cleanup(ot.b.Close)
+
+	state := resolver.State{Attributes: attributes.New(resolverInfoKey{}, resolverInfo{base: &base, service: "GreeterServer"})}
+	for i := 0; i < n; i++ {
+		addr := fmt.Sprintf("10.0.0.%d:80", i)
+		ot.addrs = append(ot.addrs, addr)
+		state.Addresses = append(state.Addresses, instanceAddress(Instance{ServerID: addr, Address: addr}))
+	}
+	if err := ot.b.UpdateClientConnState(balancer.ClientConnState{ResolverState: state, BalancerConfig: lbConfig}); err != nil {
+		t.Fatal(err)
+	}
+	for _, sc := range ot.cc.subConns {
+		ot.b.UpdateSubConnState(sc, balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	}
+	return ot
+}
+
+// record 为 addr 记录 total 次请求, 其中 failed 次失败, 每次耗时 latency
+func (ot *outlierTest) record(addr string, total, failed int, latency time.Duration) {
+	for i := 0; i < total; i++ {
+		var err error
+		if i < failed {
+			err = status.Error(codes.Unavailable, "down")
+		}
+		ot.b.record(addr, time.Now().Add(-latency), err)
+	}
+}
+
+// healthy 为除 except 之外的地址记录一个周期的正常请求
+func (ot *outlierTest) healthy(except ...string) {
+	skip := map[string]bool{}
+	for _, addr := range except {
+		skip[addr] = true
+	}
+	for _, addr := range ot.addrs {
+		if !skip[addr] {
+			ot.record(addr, 20, 0, time.Millisecond)
+		}
+	}
+}
+
+func (ot *outlierTest) takeEvents() []OutlierEvent {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	events := ot.events
+	ot.events = nil
+	return events
+}
+
+// picked picker 选中的地址
+func (ot *outlierTest) picked() map[string]bool {
+	ot.t.Helper()
+	ot.cc.mu.Lock()
+	picker := ot.cc.picker
+	ot.cc.mu.Unlock()
+
+	picked := map[string]bool{}
+	for i := 0; i < 4*len(ot.addrs); i++ {
+		res, err := picker.Pick(balancer.PickInfo{Ctx: context.Background()})
+		if err != nil {
+			ot.t.Fatal(err)
+		}
+		picked[res.SubConn.(*fakeSubConn).name] = true
+	}
+	return picked
+}
+
+// expire 让 addr 的本次摘除到期
+func (ot *outlierTest) expire(addr string) {
+	ot.b.mu.Lock()
+	defer ot.b.mu.Unlock()
+	a := ot.b.addrs[addr]
+	a.ejectedAt = a.ejectedAt.Add(-ot.b.config.ejectionTime(a.ejections))
+}
+
+func TestOutlierEjectsByFailureRate(t *testing.T) {
+	ot := newOutlierTest(t, 4, `{"maxEjectionPercent":50}`, nil)
+	bad := ot.addrs[0]
+
+	// 请求数不足时不判断
+	ot.record(bad, 9, 9, time.Millisecond)
+	ot.healthy(bad)
+	ot.b.tick()
+	if events := ot.takeEvents(); len(events) != 0 {
+		t.Fatalf("events below minimumRequests = %+v", events)
+	}
+
+	ot.record(bad, 10, 5, time.Millisecond)
+	ot.healthy(bad)
+	ot.b.tick()
+	events := ot.takeEvents()
+	if len(events) != 1 || !events[0].Ejected || events[0].Address != bad || events[0].Reason != "failure rate" ||
+		events[0].Service != "GreeterServer" || events[0].Duration != 30*time.Second {
+		t.Fatalf("events = %+v, want %s ejected for failure rate", events, bad)
+	}
+	if picked := ot.picked(); picked[bad] || len(picked) != 3 {
+		t.Fatalf("picked = %v, want all but %s", picked, bad)
+	}
+}
+
+func TestOutlierEjectsByLatency(t *testing.T) {
+	ot := newOutlierTest(t, 4, `{"maxEjectionPercent":50,"latencyFactor":3}`, nil)
+	slow := ot.addrs[1]
+
+	ot.record(slow, 20, 0, 100*time.Millisecond)
+	ot.healthy(slow)
+	ot.b.tick()
+	events := ot.takeEvents()
+	if len(events) != 1 || events[0].Address != slow || events[0].Reason != "latency" {
+		t.Fatalf("events = %+v, want %s ejected for latency", events, slow)
+	}
+
+	// 地址数少于 minimumHosts 时不按延迟摘除
+	ot = newOutlierTest(t, 2, `{"maxEjectionPercent":50,"minimumHosts":3}`, nil)
+	ot.record(ot.addrs[0], 20, 0, 100*time.Millisecond)
+	ot.record(ot.addrs[1], 20, 0, time.Millisecond)
+	ot.b.tick()
+	if events := ot.takeEvents(); len(events) != 0 {
+		t.Fatalf("events below minimumHosts = %+v", events)
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	ot := newOutlierTest(t, 4, `{"maxEjectionPercent":50}`, nil)
+	for _, addr := range ot.addrs {
+		ot.record(addr, 10, 10, time.Millisecond)
+	}
+	ot.b.tick()
+	if events := ot.takeEvents(); len(events) != 2 {
+		t.Fatalf("ejected %d of 4 addresses, want 2", len(events))
+	}
+	if picked := ot.picked(); len(picked) != 2 {
+		t.Fatalf("picked = %v, want the 2 addresses left", picked)
+	}
+
+	// 已摘除的地址计入上限, 下一个周期不再摘除
+	for _, addr := range ot.addrs {
+		ot.record(addr, 10, 10, time.Millisecond)
+	}
+	ot.b.tick()
+	if events := ot.takeEvents(); len(events) != 0 {
+		t.Fatalf("events over the cap = %+v", events)
+	}
+}
+
+func TestOutlierEjectionBackoff(t *testing.T) {
+	config := defaultOutlierConfig()
+	for n, want := range []time.Duration{30, 30, 60, 120, 240, 300, 300} {
+		if got := config.ejectionTime(n); got != want*time.Second {
+			t.Errorf("ejectionTime(%d) = %s, want %s", n, got, want*time.Second)
+		}
+	}
+
+	ot := newOutlierTest(t, 4, `{"maxEjectionPercent":50,"baseEjectionTime":"1s","maxEjectionTime":"10s"}`, nil)
+	bad := ot.addrs[0]
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		ot.record(bad, 10, 10, time.Millisecond)
+		ot.healthy(bad)
+		ot.b.tick()
+		events := ot.takeEvents()
+		if len(events) != 1 || !events[0].Ejected || events[0].Duration != want {
+			t.Fatalf("events = %+v, want ejection for %s", events, want)
+		}
+
+		// 未到期时保持摘除
+		ot.b.tick()
+		if events := ot.takeEvents(); len(events) != 0 {
+			t.Fatalf("events before expiry = %+v", events)
+		}
+		ot.expire(bad)
+		ot.b.tick()
+		events = ot.takeEvents()
+		if len(events) != 1 || events[0].Ejected || events[0].Address != bad {
+			t.Fatalf("events = %+v, want %s restored", events, bad)
+		}
+		if picked := ot.picked(); !picked[bad] {
+			t.Fatalf("picked = %v, want restored %s", picked, bad)
+		}
+	}
+
+	// 正常的周期减少连续摘除次数
+	ot.healthy()
+	ot.b.tick()
+	ot.record(bad, 10, 10, time.Millisecond)
+	ot.healthy(bad)
+	ot.b.tick()
+	if events := ot.takeEvents(); len(events) != 1 || events[0].Duration != 4*time.Second {
+		t.Fatalf("events = %+v, want ejection for 4s after one healthy interval", events)
+	}
+}
+
+func TestOutlierListenerCallsBalancer(t *testing.T) {
+	// listener 回调 balancer 时不能死锁
+	ot := newOutlierTest(t, 4, `{"maxEjectionPercent":50}`, func(ot *outlierTest, event OutlierEvent) {
+		ot.b.ExitIdle()
+		ot.b.ResolverError(fmt.Errorf("listener"))
+	})
+	ot.record(ot.addrs[0], 10, 10, time.Millisecond)
+	ot.healthy(ot.addrs[0])
+
+	runWithin(t, 5*time.Second, "tick", func() error {
+		ot.b.tick()
+		return nil
+	})
+	if events := ot.takeEvents(); len(events) != 1 {
+		t.Fatalf("events = %+v, want 1", events)
+	}
+}
@@ -1,9 +1,8 @@
 package grpc_discover
 
 import (
-	"fmt"
 	"github.com/pkg/errors"
-	"github.com/rs/xid"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
@@ -32,20 +31,83 @@ func Signal(call func()) {
 	}()
 }
 
-func getServerID(serverName string) string {
-	return fmt.Sprintf("grpc-discover-%s-%s", serverName, xid.New().String())
+// serverID 格式为 grpc-discover/<serverName>/<instanceID>, 指定 namespace 时为
+// grpc-discover@<namespace>/<serverName>/<instanceID>. 各段都经过 url.PathEscape,
+// 因此服务名和实例 ID 中可以包含 "-" 和 "/", 前缀扫描也不会匹配到其它服务或 namespace.
+const serverIDRoot = "grpc-discover"
+
+// getServerIDRoot namespace 对应的第一段
+func getServerIDRoot(namespace string) string {
+	if namespace == "" {
+		return serverIDRoot
+	}
+	return serverIDRoot + "@" + url.PathEscape(namespace)
+}
+
+// getInstanceServerID 调用方指定实例 ID 时的 serverID, 同一实例重启后保持不变
+func getInstanceServerID(namespace string, serverName string, instanceID string) string {
+	return getServerIDPrefix(namespace, serverName) + url.PathEscape(instanceID)
+}
+
+// getServerIDPrefix 服务下所有 serverID 的公共前缀, 以分隔符结尾
+func getServerIDPrefix(namespace string, serverName string) string {
+	return getServerIDRoot(namespace) + "/" + url.PathEscape(serverName) + "/"
+}
+
+// parseServerID 从 serverID 中解析出 namespace、服务名和实例 ID, 兼容旧格式
+func parseServerID(serverID string) (namespace string, serverName string, instanceID string, err error) {
+	if parts := strings.Split(serverID, "/"); len(parts) == 3 {
+		var ok bool
+		if namespace, ok = parseServerIDRoot(parts[0]); ok {
+			serverName, err1 := url.PathUnescape(parts[1])
+			instanceID, err2 := url.PathUnescape(parts[2])
+			if err1 == nil && err2 == nil && serverName != "" && instanceID != "" {
+				return namespace, serverName, instanceID, nil
+			}
+		}
+	} else if rest := strings.TrimPrefix(serverID, legacyServerIDRoot); rest != serverID {
+		// 旧格式的实例 ID 为 xid, 不含 "-"; 含 "/" 或 "@" 的是新格式或配置的 key
+		if i := strings.LastIndex(rest, "-"); i > 0 && i < len(rest)-1 && !strings.ContainsAny(rest, "/@") {
+			return "", rest[:i], rest[i+1:], nil
+		}
+	}
+	return "", "", "", errors.Errorf("invalid server id %q", serverID)
+}
+
+// parseServerIDRoot 解析 serverID 的第一段
+func parseServerIDRoot(root string) (namespace string, ok bool) {
+	if root == serverIDRoot {
+		return "", true
+	}
+	rest := strings.TrimPrefix(root, serverIDRoot+"@")
+	if rest == root {
+		return "", false
+	}
+	namespace, err := url.PathUnescape(rest)
+	return namespace, err == nil && namespace != ""
+}
+
+// legacyServerIDRoot 旧格式 grpc-discover-<serverName>-<xid> 的前缀
+const legacyServerIDRoot = "grpc-discover-"
+
+func getLegacyServerID(serverName string, instanceID string) string {
+	return legacyServerIDRoot + serverName + "-" + instanceID
 }
 
-func getServerIDPrefix(serverName string) string {
-	return fmt.Sprintf("grpc-discover-%s", serverName)
+// getLegacyServerIDPrefix 旧格式的前缀, 会匹配到以 serverName + "-" 开头的其它服务,
+// 需要再用 isServerIDOf 过滤
+func getLegacyServerIDPrefix(serverName string) string {
+	return legacyServerIDRoot + serverName + "-"
 }
 
-func getServerNameByIDConsulVersion(serverID string) string {
-	split := strings.Split(serverID, "-")
-	return split[2]
+// isServerIDOf serverID 是否属于 namespace 下的 serverName
+func isServerIDOf(serverID string, namespace string, serverName string) bool {
+	ns, name, _, err := parseServerID(serverID)
+	return err == nil && ns == namespace && name == serverName
 }
 
 // errors
 var (
 	ErrServiceNotFound = errors.New("service not found")
+	ErrPluginClosed    = errors.New("plugin closed")
 )
@@ -0,0 +1,110 @@
+package grpc_discover
+
+import "testing"
+
+func TestServerIDRoundTrip(t *testing.T) {
+	tests := []struct {
+		namespace, serverName, instanceID string
+		want                              string
+	}{
+		{"", "GreeterServer", "pod-0", "grpc-discover/GreeterServer/pod-0"},
+		{"prod", "GreeterServer", "pod-0", "grpc-discover@prod/GreeterServer/pod-0"},
+		{"", "user-profile", "10.0.0.5:8080", "grpc-discover/user-profile/10.0.0.5:8080"},
+		{"team/a", "pkg.Service/v1", "a/b;c", "grpc-discover@team%2Fa/pkg.Service%2Fv1/a%2Fb%3Bc"},
+		{"a@b", "x@y", "z@w", "grpc-discover@a@b/x@y/z@w"},
+	}
+	for _, tt := range tests {
+		serverID := getInstanceServerID(tt.namespace, tt.serverName, tt.instanceID)
+		if serverID != tt.want {
+			t.Errorf("getInstanceServerID(%q, %q, %q) = %q, want %q", tt.namespace, tt.serverName, tt.instanceID, serverID, tt.want)
+		}
+		namespace, serverName, instanceID, err := parseServerID(serverID)
+		if err != nil || namespace != tt.namespace || serverName != tt.serverName || instanceID != tt.instanceID {
+			t.Errorf("parseServerID(%q) = %q, %q, %q, %v", serverID, namespace, serverName, instanceID, err)
+		}
+	}
+}
+
+func TestParseServerID(t *testing.T) {
+	tests := []struct {
+		serverID                          string
+		namespace, serverName, instanceID string
+		ok                                bool
+	}{
+		{"grpc-discover-GreeterServer-cgl3k1i5p8s7bq3hb7ng", "", "GreeterServer", "cgl3k1i5p8s7bq3hb7ng", true},
+		{"grpc-discover-user-profile-cgl3k1i5p8s7bq3hb7ng", "", "user-profile", "cgl3k1i5p8s7bq3hb7ng", true},
+		{"grpc-discover-config@ns/user-profile", "", "", "", false},
+		{"grpc-discover-config/user-profile", "", "", "", false},
+		{"grpc-discover-split@ns-x", "", "", "", false},
+		{"grpc-discover-Greeter", "", "", "", false},
+		{"grpc-discover-Greeter-", "", "", "", false},
+		{"grpc-discover--x", "", "", "", false},
+		{"grpc-discover/Greeter", "", "", "", false},
+		{"grpc-discover/Greeter/", "", "", "", false},
+		{"grpc-discover@/Greeter/x", "", "", "", false},
+		{"grpc-discover-config/GreeterServer", "", "", "", false},
+		{"other/Greeter/x", "", "", "", false},
+		{"grpc-discover/Greeter/%zz", "", "", "", false},
+	}
+	for _, tt := range tests {
+		namespace, serverName, instanceID, err := parseServerID(tt.serverID)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseServerID(%q) error = %v, want ok %v", tt.serverID, err, tt.ok)
+			continue
+		}
+		if tt.ok && (namespace != tt.namespace || serverName != tt.serverName || instanceID != tt.instanceID) {
+			t.Errorf("parseServerID(%q) = %q, %q, %q, want %q, %q, %q", tt.serverID,
+				namespace, serverName, instanceID, tt.namespace, tt.serverName, tt.instanceID)
+		}
+	}
+}
+
+func TestNamespaceSet(t *testing.T) {
+	set := namespaceSet{}
+	for _, key := range []string{
+		"grpc-discover/GreeterServer/pod-0",
+		"grpc-discover@prod/GreeterServer/pod-0",
+		"grpc-discover-GreeterServer-cgl3k1i5p8s7bq3hb7ng",
+		getServiceConfigKey("", "user-profile"),
+		getServiceConfigKey("staging", "user-profile"),
+		getTrafficSplitKey("", "user-profile"),
+		getTrafficSplitKey("canary", "user-profile"),
+	} {
+		set.add(key)
+	}
+	got := set.list()
+	want := []string{"", "prod"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("namespaces = %q, want %q", got, want)
+	}
+}
+
+func TestLegacyServerIDOf(t *testing.T) {
+	base, err := newPluginBase("fake", []Option{WithLegacyServerIDs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		serverName, instanceID string
+		want                   string
+	}{
+		{"GreeterServer", "cgl3k1i5p8s7bq3hb7ng", "grpc-discover-GreeterServer-cgl3k1i5p8s7bq3hb7ng"},
+		{"user-profile", "cgl3k1i5p8s7bq3hb7ng", "grpc-discover-user-profile-cgl3k1i5p8s7bq3hb7ng"},
+		{"Greeter", "pod-0", "grpc-discover/Greeter/pod-0"},
+		{"Greeter", "a/b", "grpc-discover/Greeter/a%2Fb"},
+		{"Greeter", "a@b", "grpc-discover/Greeter/a@b"},
+		{"pkg.Service/v1", "x", "grpc-discover/pkg.Service%2Fv1/x"},
+	}
+	for _, tt := range tests {
+		serverID := base.serverIDOf(tt.serverName, tt.instanceID)
+		if serverID != tt.want {
+			t.Errorf("serverIDOf(%q, %q) = %q, want %q", tt.serverName, tt.instanceID, serverID, tt.want)
+		}
+		if !base.ownsServerID(serverID, tt.serverName) {
+			t.Errorf("ownsServerID(%q, %q) = false", serverID, tt.serverName)
+		}
+		if _, _, instanceID, err := parseServerID(serverID); err != nil || instanceID != tt.instanceID {
+			t.Errorf("parseServerID(%q) instance ID = %q, %v, want %q", serverID, instanceID, err, tt.instanceID)
+		}
+	}
+}
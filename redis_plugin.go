@@ -2,102 +2,393 @@ package grpc_discover
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/resolver"
 )
 
 type RedisPlugin struct {
 	client *redis.Client
+	config redis.Options
+
+	authorities *clientCache[*redis.Client]
 
 	mu    sync.Mutex
-	close map[string]chan struct{}
+	close map[string]redisRegistration
+
+	pluginBase
+}
+
+type redisRegistration struct {
+	serverName string
+	close      chan struct{} // 停止心跳, RegisterGroup 注册的服务共用
+	inst       Instance      // 未签名的注册信息, SetStatus 时重新编码
+	value      string        // 心跳写入的编码结果
+	group      string        // RegisterGroup 的实例 ID, 单独注册时为空
 }
 
-func NewRedisPlugin(config *redis.Options) (*RedisPlugin, error) {
+func NewRedisPlugin(config *redis.Options, opts ...Option) (*RedisPlugin, error) {
+	base, err := newPluginBase("redis", opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := base.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		config.TLSConfig = tlsConfig
+	}
+
+	// NewClient 会补全 config 并让默认 Dialer 绑定到它, authority 客户端需要未修改的副本
+	template := *config
+	config.TLSConfig = tlsForAddress(config.TLSConfig, config.Addr)
 	client := redis.NewClient(config)
-	err := client.Ping(context.TODO()).Err()
+	err = client.Ping(context.TODO()).Err()
 	if err != nil {
 		return nil, err
 	}
 
-	return &RedisPlugin{client: client, close: map[string]chan struct{}{}}, err
+	r := &RedisPlugin{
+		client:     client,
+		config:     template,
+		close:      map[string]redisRegistration{},
+		pluginBase: base,
+	}
+	r.authorities = newClientCache(r.dialAuthority, func(client *redis.Client) {
+		if err := client.Close(); err != nil {
+			r.logger.Warn("close authority client", fieldError(err))
+		}
+	})
+	return r, nil
 }
 
-func (r *RedisPlugin) Register(serverName string, address string) (serverID string, err error) {
+// dialAuthority 为 dial target authority 创建客户端
+func (r *RedisPlugin) dialAuthority(authority string) (*redis.Client, error) {
+	config := r.config
+	config.Addr = authority
+	if ac, ex := r.opt.authorities[authority]; ex {
+		if ac.Username != "" || ac.Password != "" {
+			config.Username = ac.Username
+			config.Password = ac.Password
+		}
+		if ac.TLS != nil {
+			config.TLSConfig = ac.TLS
+		}
+	}
+	config.TLSConfig = tlsForAddress(config.TLSConfig, config.Addr)
+	return redis.NewClient(&config), nil
+}
+
+func (r *RedisPlugin) Register(serverName string, address string, opts ...RegisterOption) (serverID string, err error) {
+	return r.RegisterContext(context.Background(), serverName, address, opts...)
+}
+
+// RegisterContext 服务注册, ctx 用于超时和链路追踪
+func (r *RedisPlugin) RegisterContext(ctx context.Context, serverName string, address string, opts ...RegisterOption) (serverID string, err error) {
+	ctx, span := startSpan(ctx, r.tracer, "Register", "redis", attrService.String(serverName), attrAddress.String(address))
+	defer func() { endSpan(span, err) }()
+
+	if r.life.isClosed() {
+		return "", ErrPluginClosed
+	}
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	serverID = getServerID(serverName)
+	ro := newRegisterOptions(opts)
+	serverID = r.newServerID(serverName, ro)
+	span.SetAttributes(attrServerID.String(serverID))
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
-	err = r.client.Set(ctx, serverID, address, time.Second*10).Err()
+	// SET 原子覆盖相同 serverID 的旧注册信息
+	inst := ro.instance(serverID, serverName, address)
+	value := encodeInstance(r.signInstance(inst))
+	err = r.client.Set(ctx, serverID, value, time.Second*10).Err()
 	if err != nil {
 		return "", err
 	}
 
 	closeCh := make(chan struct{})
-	r.close[serverID] = closeCh
+	old, ex := r.close[serverID]
+	r.close[serverID] = redisRegistration{serverName: serverName, close: closeCh, inst: inst, value: value}
+	if ex {
+		r.stopUnused(old.close)
+	} else {
+		r.metrics.registered(serverName)
+	}
+	r.admin.registered(inst, true)
 
-	go r.keepAlive(closeCh, serverID, address)
+	r.life.goBackground(func() { r.keepAlive(closeCh) })
 
-	log.Printf("[GRPC Discover][Redis Pugin] Register ServerName: %s ServerAddress: %s ServerID: %s \n", serverName, address, serverID)
+	r.logger.Info("register", fieldService(serverName), fieldAddress(address), fieldServerID(serverID))
 
 	return serverID, nil
 }
 
-func (r *RedisPlugin) keepAlive(closeCh chan struct{}, serverID string, address string) {
+// keepAlive 定期刷新使用 closeCh 的注册信息和过期时间, 组内的服务在一个事务中刷新
+func (r *RedisPlugin) keepAlive(closeCh chan struct{}) {
 	ticker := time.NewTicker(time.Second * 3)
+	defer ticker.Stop()
 loop:
 	for {
 		select {
 		case <-closeCh:
 			break loop
+		case <-r.life.ctx.Done():
+			break loop
 		case <-ticker.C:
-			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-			defer cancel()
+			r.heartbeat(closeCh)
+		}
+	}
+}
 
-			err := r.client.Set(ctx, serverID, address, time.Second*10).Err()
-			if err != nil {
-				log.Printf("[GRPC Discover][Redis Pugin] keepAlive Error  %s \n", err)
-			}
+// heartbeat 刷新使用 closeCh 心跳的注册信息. 写入期间持有 r.mu, 避免与 unregister
+// 和 SetStatus 交错而写回已删除的 key 或旧的状态
+func (r *RedisPlugin) heartbeat(closeCh chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	members := map[string]redisRegistration{}
+	for serverID, reg := range r.close {
+		if reg.close == closeCh {
+			members[serverID] = reg
+		}
+	}
+	if len(members) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.life.ctx, 3*time.Second)
+	defer cancel()
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for serverID, reg := range members {
+			pipe.Set(ctx, serverID, reg.value, time.Second*10)
+		}
+		return nil
+	})
+	for serverID, reg := range members {
+		r.admin.heartbeat(serverID, err)
+		if err != nil {
+			r.metrics.heartbeatFailed(reg.serverName)
+			r.logger.Warn("keepalive", fieldService(reg.serverName), fieldServerID(serverID), fieldError(err))
 		}
 	}
 }
 
+// stopUnused 没有注册信息再使用 closeCh 时停止其心跳. 调用方持有 r.mu
+func (r *RedisPlugin) stopUnused(closeCh chan struct{}) {
+	for _, reg := range r.close {
+		if reg.close == closeCh {
+			return
+		}
+	}
+	close(closeCh)
+}
+
+// RegisterGroup 在同一个实例 ID 下注册多个服务, 所有 key 在一个 MULTI/EXEC 事务中写入
+// 并由一个心跳刷新
+func (r *RedisPlugin) RegisterGroup(ctx context.Context, group ServiceGroup, opts ...RegisterOption) (reg GroupRegistration, err error) {
+	ctx, span := startSpan(ctx, r.tracer, "RegisterGroup", "redis", attrInstances.Int(len(group.Services)))
+	defer func() { endSpan(span, err) }()
+
+	if r.life.isClosed() {
+		return GroupRegistration{}, ErrPluginClosed
+	}
+
+	reg, instances, err := r.groupInstances(group, newRegisterOptions(opts))
+	if err != nil {
+		return GroupRegistration{}, err
+	}
+	span.SetAttributes(attrGroupID.String(reg.ID))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	values := make([]string, len(instances))
+	for i, inst := range instances {
+		values[i] = encodeInstance(r.signInstance(inst))
+	}
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, inst := range instances {
+			pipe.Set(ctx, inst.ServerID, values[i], time.Second*10)
+		}
+		return nil
+	})
+	if err != nil {
+		return GroupRegistration{}, err
+	}
+
+	closeCh := make(chan struct{})
+	var replaced []chan struct{}
+	for i, inst := range instances {
+		old, ex := r.close[inst.ServerID]
+		r.close[inst.ServerID] = redisRegistration{serverName: inst.ServiceName, close: closeCh, inst: inst, value: values[i], group: reg.ID}
+		if ex {
+			replaced = append(replaced, old.close)
+		} else {
+			r.metrics.registered(inst.ServiceName)
+		}
+		r.admin.registered(inst, true)
+	}
+	for _, old := range replaced {
+		r.stopUnused(old)
+	}
+
+	r.life.goBackground(func() { r.keepAlive(closeCh) })
+
+	r.logger.Info("register group", Any("group", reg.ID), Any("services", len(instances)))
+
+	return reg, nil
+}
+
+// UnRegisterGroup 反注册 RegisterGroup 注册的所有服务, 所有 key 在一个事务中删除.
+// 配置了 WithDrainTimeout 时先将所有服务标记为 draining 并等待
+func (r *RedisPlugin) UnRegisterGroup(ctx context.Context, groupID string) (err error) {
+	ctx, span := startSpan(ctx, r.tracer, "UnRegisterGroup", "redis", attrGroupID.String(groupID))
+	defer func() { endSpan(span, err) }()
+
+	serverIDs := r.groupMembers(groupID)
+	if len(serverIDs) == 0 {
+		return errors.New("service group does not exist")
+	}
+	ctx, done := r.drain(ctx, serverIDs, r.SetStatus)
+	defer done()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, serverID := range serverIDs {
+		reg, ex := r.close[serverID]
+		if !ex {
+			continue
+		}
+		delete(r.close, serverID)
+		r.stopUnused(reg.close)
+		r.metrics.unregistered(reg.serverName)
+		r.admin.unregistered(serverID)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	return r.client.Del(ctx, serverIDs...).Err()
+}
+
+// groupMembers RegisterGroup 注册的仍然存在的 serverID
+func (r *RedisPlugin) groupMembers(groupID string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var serverIDs []string
+	for serverID, reg := range r.close {
+		if reg.group != "" && reg.group == groupID {
+			serverIDs = append(serverIDs, serverID)
+		}
+	}
+	sort.Strings(serverIDs)
+	return serverIDs
+}
+
 func (r *RedisPlugin) UnRegister(serverID string) error {
+	return r.UnRegisterContext(context.Background(), serverID)
+}
+
+// UnRegisterContext 服务反注册, ctx 用于超时和链路追踪. 配置了 WithDrainTimeout 时
+// 先将实例标记为 draining 并等待
+func (r *RedisPlugin) UnRegisterContext(ctx context.Context, serverID string) (err error) {
+	ctx, span := startSpan(ctx, r.tracer, "UnRegister", "redis", attrServerID.String(serverID))
+	defer func() { endSpan(span, err) }()
+
+	ctx, done := r.drain(ctx, []string{serverID}, r.SetStatus)
+	defer done()
+	return r.unregister(ctx, serverID)
+}
+
+// SetStatus 修改本插件注册的实例的状态, draining / disabled 的实例不再由 resolver 下发
+func (r *RedisPlugin) SetStatus(ctx context.Context, serverID string, status InstanceStatus) error {
+	if err := status.validate(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reg, ex := r.close[serverID]
+	if !ex {
+		return errors.New("service does not exist")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	reg.inst.Status = status
+	value := encodeInstance(r.signInstance(reg.inst))
+	if err := r.client.Set(ctx, serverID, value, time.Second*10).Err(); err != nil {
+		return err
+	}
+	reg.value = value
+	r.close[serverID] = reg
+	r.admin.setStatus(serverID, status)
+	r.logger.Info("set status", fieldServerID(serverID), Any("status", status))
+	return nil
+}
+
+// unregister 停止心跳并删除注册信息
+func (r *RedisPlugin) unregister(ctx context.Context, serverID string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	c, ex := r.close[serverID]
+	reg, ex := r.close[serverID]
 	if !ex {
 		return errors.New("service does not exist")
 	}
+	trace.SpanFromContext(ctx).SetAttributes(attrService.String(reg.serverName))
 
-	close(c)
+	delete(r.close, serverID)
+	r.stopUnused(reg.close)
+	r.metrics.unregistered(reg.serverName)
+	r.admin.unregistered(serverID)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
-	err := r.client.Del(ctx, serverID).Err()
-	return err
+	return r.client.Del(ctx, serverID).Err()
 }
 
 func (r *RedisPlugin) AutoUnRegister(serverID string) {
 	Signal(func() {
-		r.UnRegister(serverID)
+		if err := r.UnRegister(serverID); err != nil {
+			r.logger.Error("unregister", fieldServerID(serverID), fieldError(err))
+		}
 	})
 }
 
 func (r *RedisPlugin) DiscoverByServerName(serverName string) ([]string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	return r.DiscoverByServerNameContext(context.Background(), serverName)
+}
+
+func (r *RedisPlugin) DiscoverByServerNameContext(ctx context.Context, serverName string) (srvAddress []string, err error) {
+	ctx, span := startSpan(ctx, r.tracer, "DiscoverByServerName", "redis", attrService.String(serverName))
+	defer func() {
+		span.SetAttributes(attrInstances.Int(len(srvAddress)))
+		endSpan(span, err)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	result, err := r.client.Keys(ctx, getServerIDPrefix(serverName)+"*").Result()
+	result, err := r.keys(ctx, r.client, serverName)
 	if err != nil {
 		return nil, err
 	}
@@ -106,86 +397,343 @@ func (r *RedisPlugin) DiscoverByServerName(serverName string) ([]string, error)
 		return nil, ErrServiceNotFound
 	}
 
-	var srvAddress []string
-
 	for _, v := range result {
-		val, err := r.client.Get(context.TODO(), v).Result()
+		val, err := r.client.Get(ctx, v).Result()
 		if err != nil {
 			continue
 		}
-		srvAddress = append(srvAddress, val)
+		inst := decodeInstance(v, serverName, val)
+		if !inst.Serving() || !r.verifyInstance(inst) {
+			continue
+		}
+		srvAddress = append(srvAddress, inst.Address)
 	}
 
 	return srvAddress, nil
 }
 
 func (r *RedisPlugin) DiscoverByServerID(serverID string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	return r.DiscoverByServerIDContext(context.Background(), serverID)
+}
+
+func (r *RedisPlugin) DiscoverByServerIDContext(ctx context.Context, serverID string) (address string, err error) {
+	ctx, span := startSpan(ctx, r.tracer, "DiscoverByServerID", "redis", attrServerID.String(serverID))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	val, err := r.client.Get(ctx, serverID).Result()
 	if err != nil {
+		if err == redis.Nil {
+			return "", ErrServiceNotFound
+		}
 		return "", err
 	}
 
-	return val, nil
+	inst := decodeInstance(serverID, "", val)
+	if !r.verifyInstance(inst) || !inst.Serving() {
+		return "", ErrServiceNotFound
+	}
+	return inst.Address, nil
 }
 
-func (r *RedisPlugin) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
-	rc := &redisResolver{
-		target: target,
-		cc:     cc,
-		opts:   opts,
-		r:      r,
+// Watch 监听服务实例变化, 每次变化推送全量快照, ctx 结束时关闭通道.
+// 依赖 keyspace 通知 (notify-keyspace-events 需包含 "Kg$x"), 没有通知时靠定期全量同步
+func (r *RedisPlugin) Watch(ctx context.Context, serviceName string) (<-chan []Instance, error) {
+	if serviceName == "" {
+		return nil, errors.New("service name is empty")
 	}
 
-	rc.ResolveNow(resolver.ResolveNowOptions{})
-	return rc, nil
+	return r.watch(r.client)(ctx, serviceName, watchConfig{
+		onError: func(err error) {
+			r.logger.Warn("watch", fieldService(serviceName), fieldError(err))
+		},
+	}), nil
 }
 
-func (r *RedisPlugin) Scheme() string {
-	return "redis"
-}
+// redisResyncInterval 兜底全量同步间隔, 防止 keyspace 通知丢失或未开启
+const redisResyncInterval = 10 * time.Second
 
-type redisResolver struct {
-	target resolver.Target
-	cc     resolver.ClientConn
-	opts   resolver.BuildOptions
-	r      *RedisPlugin
+// watch 订阅 keyspace 通知增量更新, 并定期全量同步
+func (r *RedisPlugin) watch(client *redis.Client) watchFunc {
+	return func(ctx context.Context, serviceName string, cfg watchConfig) <-chan []Instance {
+		set := newInstanceSet(r.verifyInstance)
+		ctx, cancel := r.life.watchContext(ctx)
+
+		r.life.goBackground(func() {
+			defer cancel()
+			defer close(set.ch)
+
+			channelPrefix := fmt.Sprintf("__keyspace@%d__:", client.Options().DB)
+			var patterns []string
+			for _, prefix := range r.serverIDPrefixes(serviceName) {
+				patterns = append(patterns, channelPrefix+redisPrefixPattern(prefix))
+			}
+			ps := client.PSubscribe(ctx, patterns...)
+			defer ps.Close()
+			msgs := ps.Channel()
+
+			ticker := time.NewTicker(redisResyncInterval)
+			defer ticker.Stop()
+
+			resync := func() {
+				err := r.list(ctx, client, serviceName, set)
+				if err != nil {
+					if ctx.Err() == nil {
+						cfg.onError(err)
+					}
+					ticker.Reset(watchRetryInterval)
+					return
+				}
+				ticker.Reset(redisResyncInterval)
+				set.flush()
+			}
+
+			resync()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-cfg.resolveNow:
+					resync()
+				case <-ticker.C:
+					resync()
+				case msg, ok := <-msgs:
+					if !ok {
+						return
+					}
+
+					serverID := strings.TrimPrefix(msg.Channel, channelPrefix)
+					if !r.ownsServerID(serverID, serviceName) {
+						continue
+					}
+					switch msg.Payload {
+					case "set":
+						value, err := client.Get(ctx, serverID).Result()
+						if err == redis.Nil {
+							set.delete(serverID)
+						} else if err != nil {
+							cfg.onError(err)
+							continue
+						} else {
+							set.put(decodeInstance(serverID, serviceName, value))
+						}
+					case "del", "expired", "evicted":
+						set.delete(serverID)
+					default:
+						continue
+					}
+					set.flush()
+				}
+			}
+		})
+
+		return set.ch
+	}
 }
 
-func (e *redisResolver) ResolveNow(options resolver.ResolveNowOptions) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// list 全量拉取
+func (r *RedisPlugin) list(ctx context.Context, client *redis.Client, serviceName string, set *instanceSet) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	result, err := e.r.client.Keys(ctx, getServerIDPrefix(e.target.Endpoint())+"*").Result()
+	start := time.Now()
+	defer func() { r.metrics.resolved(serviceName, start, err) }()
+
+	keys, err := r.keys(ctx, client, serviceName)
 	if err != nil {
-		log.Printf("[GRPC Discover][Redis Pugin] ResolveNow %s:///%s Error: %s \n", e.target.Scheme, e.target.Endpoint, err)
-		return
+		return err
 	}
 
-	if len(result) == 0 {
-		log.Printf("[GRPC Discover][Redis Pugin] ResolveNow %s:///%s Error: %s \n", e.target.Scheme, e.target.Endpoint, "could not find service")
-		return
+	instances := make([]Instance, 0, len(keys))
+	if len(keys) != 0 {
+		values, err := client.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			value, ok := v.(string)
+			if !ok {
+				// 在 KEYS 和 MGET 之间过期了
+				continue
+			}
+			instances = append(instances, decodeInstance(keys[i], serviceName, value))
+		}
 	}
+	set.reset(instances)
 
-	var srvAddress []resolver.Address
+	return nil
+}
 
-	for _, v := range result {
-		val, err := e.r.client.Get(context.TODO(), v).Result()
+// keys 列出 serviceName 下的所有 serverID
+func (r *RedisPlugin) keys(ctx context.Context, client *redis.Client, serviceName string) ([]string, error) {
+	var keys []string
+	for _, prefix := range r.serverIDPrefixes(serviceName) {
+		result, err := client.Keys(ctx, redisPrefixPattern(prefix)).Result()
 		if err != nil {
-			log.Printf("[GRPC Discover][Redis Pugin] ResolveNow %s:///%s Error: %s \n", e.target.Scheme, e.target.Endpoint, err)
-			continue
+			return nil, err
 		}
-		srvAddress = append(srvAddress, resolver.Address{
-			Addr: val,
+		for _, key := range result {
+			if r.ownsServerID(key, serviceName) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// redisPrefixPattern 匹配 prefix 开头的 key 的 glob 模式, 转义 prefix 中的通配符
+func redisPrefixPattern(prefix string) string {
+	var b strings.Builder
+	for _, c := range prefix {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	b.WriteByte('*')
+	return b.String()
+}
+
+// SetServiceConfig 发布服务的 gRPC service config JSON, resolver 会随地址一起下发,
+// serviceConfig 为空时删除
+func (r *RedisPlugin) SetServiceConfig(ctx context.Context, serviceName string, serviceConfig string) error {
+	if err := validateServiceConfig(serviceConfig); err != nil {
+		return err
+	}
+	return r.setValue(ctx, getServiceConfigKey(r.opt.namespace, serviceName), serviceConfig)
+}
+
+// SetTrafficSplit 发布服务的流量拆分规则, split 为 nil 时删除
+func (r *RedisPlugin) SetTrafficSplit(ctx context.Context, serviceName string, split *TrafficSplit) error {
+	value, err := encodeTrafficSplit(split)
+	if err != nil {
+		return err
+	}
+	return r.setValue(ctx, getTrafficSplitKey(r.opt.namespace, serviceName), value)
+}
+
+// setValue 写入不过期的配置 key, value 为空时删除
+func (r *RedisPlugin) setValue(ctx context.Context, key string, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	if value == "" {
+		return r.client.Del(ctx, key).Err()
+	}
+	return r.client.Set(ctx, key, value, 0).Err()
+}
+
+// watchValue 订阅配置 key 的 keyspace 通知, 并定期重新读取
+func (r *RedisPlugin) watchValue(client *redis.Client) valueWatchFunc {
+	return func(ctx context.Context, key string, onError func(error)) <-chan string {
+		value := newConfigValue()
+		ctx, cancel := r.life.watchContext(ctx)
+
+		r.life.goBackground(func() {
+			defer cancel()
+			defer close(value.ch)
+
+			ps := client.Subscribe(ctx, fmt.Sprintf("__keyspace@%d__:%s", client.Options().DB, key))
+			defer ps.Close()
+			msgs := ps.Channel()
+
+			ticker := time.NewTicker(redisResyncInterval)
+			defer ticker.Stop()
+			for {
+				gctx, gcancel := context.WithTimeout(ctx, 3*time.Second)
+				config, err := client.Get(gctx, key).Result()
+				gcancel()
+				switch {
+				case err == redis.Nil:
+					value.set("")
+				case err != nil:
+					if ctx.Err() == nil {
+						onError(err)
+					}
+				default:
+					value.set(config)
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				case _, ok := <-msgs:
+					if !ok {
+						return
+					}
+				}
+			}
 		})
+
+		return value.ch
 	}
+}
 
-	err = e.cc.UpdateState(resolver.State{Addresses: srvAddress})
+// Namespaces 列出当前 DB 中存在实例的 namespace, 默认 namespace 为 ""
+func (r *RedisPlugin) Namespaces(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	keys, err := r.client.Keys(ctx, redisPrefixPattern(serverIDRoot)).Result()
 	if err != nil {
-		log.Printf("[GRPC Discover][Redis Pugin] ResolveNow %s:///%s Error: %s \n", e.target.Scheme, e.target.Endpoint, err)
+		return nil, err
 	}
+
+	set := namespaceSet{}
+	for _, key := range keys {
+		set.add(key)
+	}
+	return set.list(), nil
 }
 
-func (e *redisResolver) Close() {}
+// Close 关闭插件, 默认先反注册本插件注册的实例 (见 WithUnregisterOnClose),
+// 然后停止心跳和 watch, 关闭所有 redis 客户端
+func (r *RedisPlugin) Close(ctx context.Context) error {
+	err := r.shutdown(ctx, r.registered, r.SetStatus, r.unregister)
+	if err == ErrPluginClosed {
+		return err
+	}
+
+	r.authorities.closeAll()
+	if cerr := r.client.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// registered 本插件注册的 serverID
+func (r *RedisPlugin) registered() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	serverIDs := make([]string, 0, len(r.close))
+	for serverID := range r.close {
+		serverIDs = append(serverIDs, serverID)
+	}
+	return serverIDs
+}
+
+// Build 创建 resolver, target 的 authority 不为空时连接其中的 redis:
+//
+//	redis:///GreeterServer               插件自身的 redis
+//	redis://10.0.0.5:6379/GreeterServer  10.0.0.5:6379 上的 redis
+func (r *RedisPlugin) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	if target.URL.Host == "" {
+		return newDiscoverResolver(&r.pluginBase, r.watch(r.client), r.watchValue(r.client), target, cc)
+	}
+
+	client, release, err := r.authorities.acquire(target.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	rr, err := newDiscoverResolver(&r.pluginBase, r.watch(client), r.watchValue(client), target, cc)
+	return releaseOnClose(rr, err, release)
+}
+
+func (r *RedisPlugin) Scheme() string {
+	return "redis"
+}
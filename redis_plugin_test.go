@@ -0,0 +1,54 @@
+package grpc_discover
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisHeartbeatFollowsRegistration(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.close()
+
+	plugin, err := NewRedisPlugin(&redis.Options{Addr: fake.addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = plugin.Close(ctx)
+	}()
+
+	ctx := context.Background()
+	serverID, err := plugin.RegisterContext(ctx, "GreeterServer", "127.0.0.1:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin.mu.Lock()
+	closeCh := plugin.close[serverID].close
+	plugin.mu.Unlock()
+
+	if err := plugin.SetStatus(ctx, serverID, StatusDraining); err != nil {
+		t.Fatal(err)
+	}
+	plugin.heartbeat(closeCh)
+	sets := fake.sets()
+	last := sets[len(sets)-1]
+	inst := decodeInstance(serverID, "GreeterServer", last[1])
+	if last[0] != serverID || inst.Status != StatusDraining {
+		t.Fatalf("heartbeat wrote %q with status %q, want %q draining", last[0], inst.Status, serverID)
+	}
+
+	// 反注册后的心跳不再写回 key
+	if err := plugin.UnRegisterContext(ctx, serverID); err != nil {
+		t.Fatal(err)
+	}
+	n := len(fake.sets())
+	plugin.heartbeat(closeCh)
+	if got := len(fake.sets()); got != n {
+		t.Fatalf("heartbeat after unregister sent %d SET commands", got-n)
+	}
+}
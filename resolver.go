@@ -0,0 +1,284 @@
+package grpc_discover
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// discoverResolver 基于插件 watch 实现的 gRPC resolver, 三个插件共用
+type discoverResolver struct {
+	target   resolver.Target
+	cc       resolver.ClientConn
+	base     *pluginBase
+	name     string // 服务名
+	serverID string // 非空时只解析这一个实例
+
+	filter instanceFilter
+
+	serviceConfig *serviceconfig.ParseResult // 最后一次有效的 service config
+	split         *TrafficSplit              // 最后一次有效的流量拆分规则
+
+	mu          sync.Mutex // 保护以下供 admin handler 查询的状态
+	addresses   []string
+	lastUpdate  time.Time
+	lastError   error
+	lastErrorAt time.Time
+
+	cancel     context.CancelFunc
+	resolveNow chan struct{}
+	done       chan struct{}
+}
+
+// newDiscoverResolver watchValue 为 nil 时不下发 service config 和流量拆分规则
+func newDiscoverResolver(base *pluginBase, watch watchFunc, watchValue valueWatchFunc, target resolver.Target, cc resolver.ClientConn) (resolver.Resolver, error) {
+	if base.life.isClosed() {
+		return nil, ErrPluginClosed
+	}
+
+	query, err := targetQuery(target)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := parseInstanceFilter(query)
+	if err != nil {
+		return nil, err
+	}
+
+	name, serverID := targetEndpoint(target)
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &discoverResolver{
+		target:     target,
+		cc:         cc,
+		base:       base,
+		name:       name,
+		serverID:   serverID,
+		filter:     filter,
+		cancel:     cancel,
+		resolveNow: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+
+	ch := watch(ctx, r.serviceName(), watchConfig{
+		onError:    r.onError,
+		resolveNow: r.resolveNow,
+	})
+	var configs, splits <-chan string
+	if watchValue != nil {
+		namespace := base.opt.namespace
+		configs = watchValue(ctx, getServiceConfigKey(namespace, r.serviceName()), r.onConfigError)
+		splits = watchValue(ctx, getTrafficSplitKey(namespace, r.serviceName()), r.onConfigError)
+	}
+	base.admin.addResolver(r)
+	go r.run(ch, configs, splits)
+	return r, nil
+}
+
+func (r *discoverResolver) serviceName() string {
+	return r.name
+}
+
+// run 合并实例、service config 和流量拆分规则的变化, 收到第一份实例列表之前不推送
+func (r *discoverResolver) run(ch <-chan []Instance, configs <-chan string, splits <-chan string) {
+	defer close(r.done)
+
+	var instances []Instance
+	received := false
+	for {
+		select {
+		case list, ok := <-ch:
+			if !ok {
+				return
+			}
+			instances, received = list, true
+		case serviceConfig, ok := <-configs:
+			if !ok {
+				configs = nil
+				continue
+			}
+			r.setServiceConfig(serviceConfig)
+			if !received {
+				continue
+			}
+		case split, ok := <-splits:
+			if !ok {
+				splits = nil
+				continue
+			}
+			r.setTrafficSplit(split)
+			if !received {
+				continue
+			}
+		}
+		r.update(instances)
+	}
+}
+
+// setServiceConfig 解析 service config, 无效时保留上一次有效的配置
+func (r *discoverResolver) setServiceConfig(serviceConfig string) {
+	if serviceConfig == "" {
+		r.serviceConfig = nil
+		return
+	}
+
+	result := r.cc.ParseServiceConfig(serviceConfig)
+	if result.Err != nil {
+		r.base.logger.Error("service config", fieldTarget(r.target.URL.String()), fieldError(result.Err))
+		return
+	}
+	r.serviceConfig = result
+}
+
+// selectServerID 只保留 dial target 指定的实例
+func (r *discoverResolver) selectServerID(instances []Instance) []Instance {
+	for _, inst := range instances {
+		if matchServerID(inst, r.serverID) {
+			return []Instance{inst}
+		}
+	}
+	return nil
+}
+
+// setTrafficSplit 解析流量拆分规则, 无效时保留上一次有效的规则
+func (r *discoverResolver) setTrafficSplit(value string) {
+	if value == "" {
+		r.split = nil
+		return
+	}
+
+	split, err := decodeTrafficSplit(value)
+	if err != nil {
+		r.base.logger.Error("traffic split", fieldTarget(r.target.URL.String()), fieldError(err))
+		return
+	}
+	r.split = split
+}
+
+func (r *discoverResolver) update(instances []Instance) {
+	var err error
+	instances = r.filter.apply(servingInstances(instances))
+	if r.serverID != "" {
+		instances = r.selectServerID(instances)
+	}
+	_, span := startSpan(context.Background(), r.base.tracer, "Resolve", r.base.backend,
+		attrService.String(r.serviceName()), attrInstances.Int(len(instances)))
+	defer func() { endSpan(span, err) }()
+
+	if len(instances) == 0 {
+		r.base.logger.Warn("resolve", fieldTarget(r.target.URL.String()), fieldError(ErrServiceNotFound))
+		if r.serverID != "" {
+			// 先推送空列表使已有连接失效, 再报告具体原因
+			notFound := errors.Wrapf(ErrServiceNotFound, "server id %q of %s", r.serverID, r.name)
+			defer func() {
+				r.setError(notFound)
+				r.cc.ReportError(notFound)
+			}()
+		}
+	}
+
+	addrs := make([]resolver.Address, 0, len(instances))
+	addresses := make([]string, 0, len(instances))
+	for _, inst := range instances {
+		addresses = append(addresses, inst.Address)
+		addrs = append(addrs, resolver.Address{
+			Addr:               inst.Address,
+			BalancerAttributes: attributes.New(instanceKey{}, inst),
+		})
+	}
+
+	err = r.cc.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.serviceConfig,
+		Attributes: attributes.New(resolverInfoKey{}, resolverInfo{
+			base:    r.base,
+			service: r.serviceName(),
+			split:   r.split,
+		}),
+	})
+	r.mu.Lock()
+	r.addresses, r.lastUpdate = addresses, time.Now()
+	r.mu.Unlock()
+	if err != nil {
+		r.setError(err)
+		r.base.metrics.resolveFailed(r.serviceName())
+		r.base.logger.Error("update state", fieldTarget(r.target.URL.String()), fieldError(err))
+		return
+	}
+	r.base.metrics.updated(r.serviceName(), len(addrs))
+}
+
+func (r *discoverResolver) setError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastError, r.lastErrorAt = err, time.Now()
+}
+
+// adminSnapshot 最近一次推送的状态, 供 admin handler 展示
+func (r *discoverResolver) adminSnapshot() AdminResolver {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := AdminResolver{
+		Target:      r.target.URL.String(),
+		Service:     r.serviceName(),
+		Addresses:   append([]string{}, r.addresses...),
+		LastUpdate:  r.lastUpdate,
+		LastErrorAt: r.lastErrorAt,
+	}
+	if r.lastError != nil {
+		s.LastError = r.lastError.Error()
+	}
+	return s
+}
+
+func (r *discoverResolver) onConfigError(err error) {
+	r.base.logger.Warn("watch config", fieldTarget(r.target.URL.String()), fieldError(err))
+}
+
+func (r *discoverResolver) onError(err error) {
+	r.setError(err)
+	r.base.logger.Error("resolve", fieldTarget(r.target.URL.String()), fieldError(err))
+	r.cc.ReportError(err)
+}
+
+// ResolveNow 触发一次全量拉取, 结果没有变化时不会推送
+func (r *discoverResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+// Close 停止 watch 并等待后台 goroutine 退出
+func (r *discoverResolver) Close() {
+	r.base.admin.removeResolver(r)
+	r.cancel()
+	<-r.done
+}
+
+type instanceKey struct{}
+
+type resolverInfoKey struct{}
+
+// resolverInfo 随 resolver.State 传给本包的 balancer, 使其可以使用插件的日志、指标和回调
+type resolverInfo struct {
+	base    *pluginBase
+	service string
+	split   *TrafficSplit
+}
+
+func resolverInfoFrom(state resolver.State) (resolverInfo, bool) {
+	info, ok := state.Attributes.Value(resolverInfoKey{}).(resolverInfo)
+	return info, ok
+}
+
+// InstanceFromAddress 取出 resolver 附加在地址上的注册信息, 供自定义 balancer 使用
+func InstanceFromAddress(addr resolver.Address) (Instance, bool) {
+	inst, ok := addr.BalancerAttributes.Value(instanceKey{}).(Instance)
+	return inst, ok
+}
@@ -0,0 +1,191 @@
+package grpc_discover
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// RingHashBalancerName 一致性哈希 balancer 的名称, 通过 service config 启用:
+//
+//	{"loadBalancingConfig":[{"grpc_discover_ring_hash":{"hashHeader":"x-user-id"}}]}
+const RingHashBalancerName = "grpc_discover_ring_hash"
+
+const (
+	defaultHashHeader = "x-hash-key"
+	defaultLoadFactor = 1.25
+	defaultReplicas   = 100
+)
+
+func init() {
+	balancer.Register(&discoverBalancerBuilder{
+		name:        RingHashBalancerName,
+		parseConfig: parseRingHashConfig,
+		newPicker: func() pickerBuilder {
+			return &ringHashPickerBuilder{loads: newSubConnLoads(), config: defaultRingHashConfig()}
+		},
+	})
+}
+
+type hashKeyKey struct{}
+
+// WithHashKey 指定本次调用的哈希 key, 优先于 metadata 中的 hashHeader
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyKey{}, key)
+}
+
+type ringHashConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	HashHeader string  `json:"hashHeader,omitempty"` // 读取哈希 key 的 metadata, 默认 x-hash-key
+	LoadFactor float64 `json:"loadFactor,omitempty"` // 单个实例负载上限相对平均值的倍数, 默认 1.25
+	Replicas   int     `json:"replicas,omitempty"`   // 每个实例在环上的虚拟节点数, 默认 100
+}
+
+func defaultRingHashConfig() *ringHashConfig {
+	return &ringHashConfig{
+		HashHeader: defaultHashHeader,
+		LoadFactor: defaultLoadFactor,
+		Replicas:   defaultReplicas,
+	}
+}
+
+func parseRingHashConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	config := defaultRingHashConfig()
+	if err := json.Unmarshal(js, config); err != nil {
+		return nil, errors.Wrap(err, "grpc_discover: ring hash config")
+	}
+	if config.LoadFactor < 1 {
+		return nil, errors.Errorf("grpc_discover: ring hash loadFactor %v must be at least 1", config.LoadFactor)
+	}
+	if config.Replicas < 1 {
+		return nil, errors.Errorf("grpc_discover: ring hash replicas %d must be positive", config.Replicas)
+	}
+	config.HashHeader = strings.ToLower(config.HashHeader)
+	return config, nil
+}
+
+// ringHashPickerBuilder 每个 ClientConn 一个, 连接的负载在 picker 重建之间保留
+type ringHashPickerBuilder struct {
+	loads *subConnLoads
+
+	mu     sync.Mutex
+	config *ringHashConfig
+}
+
+func (b *ringHashPickerBuilder) setState(s balancer.ClientConnState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c, ok := s.BalancerConfig.(*ringHashConfig); ok {
+		b.config = c
+	}
+}
+
+func (b *ringHashPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	b.mu.Lock()
+	config := b.config
+	b.mu.Unlock()
+
+	b.loads.sync(info.ReadySCs)
+	p := &ringHashPicker{
+		config: config,
+		loads:  b.loads,
+		ring:   make([]ringEntry, 0, len(info.ReadySCs)*config.Replicas),
+	}
+	for sc, sci := range info.ReadySCs {
+		key := subConnKey(sci.Address)
+		load := b.loads.get(sc)
+		for i := 0; i < config.Replicas; i++ {
+			p.ring = append(p.ring, ringEntry{hash: hashString(key + "#" + strconv.Itoa(i)), sc: sc, key: key, load: load})
+		}
+		p.subConns = append(p.subConns, ringEntry{sc: sc, key: key, load: load})
+	}
+	// 哈希相同时按 key 排序, 保证结果与 map 遍历顺序无关
+	sort.Slice(p.ring, func(i, j int) bool {
+		if p.ring[i].hash != p.ring[j].hash {
+			return p.ring[i].hash < p.ring[j].hash
+		}
+		return p.ring[i].key < p.ring[j].key
+	})
+	return p
+}
+
+type ringEntry struct {
+	hash uint64
+	sc   balancer.SubConn
+	key  string
+	load *int64
+}
+
+type ringHashPicker struct {
+	config   *ringHashConfig
+	loads    *subConnLoads
+	ring     []ringEntry
+	subConns []ringEntry
+}
+
+func (p *ringHashPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	key, ok := requestHashKey(info.Ctx, p.config.HashHeader)
+	if !ok {
+		e := p.subConns[rand.Intn(len(p.subConns))]
+		return balancer.PickResult{SubConn: e.sc, Done: p.loads.start(e.load)}, nil
+	}
+
+	// 负载上限: ceil(loadFactor * (当前总请求数 + 1) / 实例数)
+	limit := int64(math.Ceil(p.config.LoadFactor * float64(atomic.LoadInt64(&p.loads.total)+1) / float64(len(p.subConns))))
+
+	h := hashString(key)
+	start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+	for i := 0; i < len(p.ring); i++ {
+		e := p.ring[(start+i)%len(p.ring)]
+		if atomic.LoadInt64(e.load)+1 <= limit {
+			return balancer.PickResult{SubConn: e.sc, Done: p.loads.start(e.load)}, nil
+		}
+	}
+	// 并发更新计数时可能全部超过上限, 退回到 key 本来的位置
+	e := p.ring[start%len(p.ring)]
+	return balancer.PickResult{SubConn: e.sc, Done: p.loads.start(e.load)}, nil
+}
+
+// requestHashKey 本次调用的哈希 key, 优先使用 WithHashKey, 其次是 metadata 中的 header
+func requestHashKey(ctx context.Context, header string) (string, bool) {
+	if key, ok := ctx.Value(hashKeyKey{}).(string); ok && key != "" {
+		return key, true
+	}
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		if values := md.Get(header); len(values) > 0 && values[0] != "" {
+			return values[0], true
+		}
+	}
+	return "", false
+}
+
+// hashString FNV-1a 对相近的短字符串分布较差, 再经过 splitmix64 的混合步骤
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
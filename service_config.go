@@ -0,0 +1,61 @@
+package grpc_discover
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// serviceConfigRoot 服务 service config 的 key 前缀, 与 serverID 分开存放:
+//
+//	grpc-discover-config/<serverName>
+//	grpc-discover-config@<namespace>/<serverName>
+const serviceConfigRoot = "grpc-discover-config"
+
+func getServiceConfigKey(namespace string, serviceName string) string {
+	root := serviceConfigRoot
+	if namespace != "" {
+		root += "@" + url.PathEscape(namespace)
+	}
+	return root + "/" + url.PathEscape(serviceName)
+}
+
+// validateServiceConfig 发布前只检查 JSON 格式, 完整的校验由 resolver 的
+// cc.ParseServiceConfig 完成, 无效的配置不会替换客户端已生效的配置. 空字符串表示删除
+func validateServiceConfig(serviceConfig string) error {
+	if serviceConfig != "" && !json.Valid([]byte(serviceConfig)) {
+		return errors.New("grpc_discover: service config is not valid JSON")
+	}
+	return nil
+}
+
+// valueWatchFunc 各插件监听配置 key (service config、流量拆分规则) 的实现, 推送最新的值,
+// key 不存在时推送 "", ctx 结束时关闭返回的通道
+type valueWatchFunc func(ctx context.Context, key string, onError func(error)) <-chan string
+
+// configValue 只保留最新值的通道, 值没有变化时不推送
+type configValue struct {
+	ch   chan string
+	last string
+	sent bool
+}
+
+func newConfigValue() *configValue {
+	return &configValue{ch: make(chan string, 1)}
+}
+
+func (v *configValue) set(value string) {
+	if v.sent && v.last == value {
+		return
+	}
+	v.last = value
+	v.sent = true
+
+	select {
+	case <-v.ch:
+	default:
+	}
+	v.ch <- value
+}
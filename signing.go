@@ -0,0 +1,153 @@
+package grpc_discover
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// SigningKey 注册信息的签名 / 校验密钥, 通过 NewHMACKey、NewEd25519Key 或
+// NewEd25519PublicKey 创建. ID 随签名一起存储, 用于在多个受信任的密钥中选择
+type SigningKey struct {
+	id     string
+	sign   func(payload []byte) []byte
+	verify func(payload []byte, sig []byte) bool
+}
+
+// NewHMACKey HMAC-SHA256 共享密钥, 可以签名也可以校验
+func NewHMACKey(id string, secret []byte) SigningKey {
+	mac := func(payload []byte) []byte {
+		h := hmac.New(sha256.New, secret)
+		h.Write(payload)
+		return h.Sum(nil)
+	}
+	return SigningKey{
+		id:   id,
+		sign: mac,
+		verify: func(payload []byte, sig []byte) bool {
+			return hmac.Equal(mac(payload), sig)
+		},
+	}
+}
+
+// NewEd25519Key Ed25519 私钥, 用于服务端签名 (也可以校验)
+func NewEd25519Key(id string, private ed25519.PrivateKey) SigningKey {
+	key := NewEd25519PublicKey(id, private.Public().(ed25519.PublicKey))
+	key.sign = func(payload []byte) []byte {
+		return ed25519.Sign(private, payload)
+	}
+	return key
+}
+
+// NewEd25519PublicKey Ed25519 公钥, 只能用于客户端校验
+func NewEd25519PublicKey(id string, public ed25519.PublicKey) SigningKey {
+	return SigningKey{
+		id: id,
+		verify: func(payload []byte, sig []byte) bool {
+			return ed25519.Verify(public, payload, sig)
+		},
+	}
+}
+
+// WithSigningKey 注册时用 key 对注册信息签名
+func WithSigningKey(key SigningKey) Option {
+	return func(o *options) {
+		o.signingKey = &key
+	}
+}
+
+// WithTrustedKeys 发现和 resolver 只接受由这些密钥之一签名的实例, 未签名或签名
+// 无效的实例会被丢弃. 轮换密钥时先把新旧密钥都加入受信任列表, 再切换签名密钥
+func WithTrustedKeys(keys ...SigningKey) Option {
+	return func(o *options) {
+		if o.trustedKeys == nil {
+			o.trustedKeys = map[string]SigningKey{}
+		}
+		for _, key := range keys {
+			o.trustedKeys[key.id] = key
+		}
+	}
+}
+
+// signature 注册信息中保存的签名
+type signature struct {
+	KeyID string
+	Value string // base64
+}
+
+// signingPayload 签名内容, 服务名和 namespace 包含在 serverID 中
+func signingPayload(inst Instance) []byte {
+	data, _ := json.Marshal(struct {
+		ServerID string            `json:"server_id"`
+		Address  string            `json:"address"`
+		Version  string            `json:"version,omitempty"`
+		Tags     []string          `json:"tags,omitempty"`
+		Metadata map[string]string `json:"metadata,omitempty"`
+		Ports    map[string]string `json:"ports,omitempty"`
+		Status   string            `json:"status,omitempty"`
+	}{inst.ServerID, inst.Address, inst.Version, inst.Tags, inst.Metadata, inst.Ports, inst.Status.stored()})
+	return data
+}
+
+// validateSigning 检查签名配置
+func validateSigning(o options) error {
+	if o.signingKey != nil && o.signingKey.sign == nil {
+		return errors.Errorf("grpc_discover: signing key %q can only verify", o.signingKey.id)
+	}
+	return nil
+}
+
+// signInstance 配置了 WithSigningKey 时为 inst 签名
+func (b *pluginBase) signInstance(inst Instance) Instance {
+	if key := b.opt.signingKey; key != nil {
+		inst.sig = signature{
+			KeyID: key.id,
+			Value: base64.StdEncoding.EncodeToString(key.sign(signingPayload(inst))),
+		}
+	}
+	return inst
+}
+
+// verifyInstance 配置了 WithTrustedKeys 时校验 inst 的签名, 校验失败的实例应当丢弃
+func (b *pluginBase) verifyInstance(inst Instance) bool {
+	if len(b.opt.trustedKeys) == 0 {
+		return true
+	}
+
+	err := verifySignature(b.opt.trustedKeys, inst)
+	if err != nil {
+		b.logger.Warn("drop instance", fieldServerID(inst.ServerID), fieldAddress(inst.Address), fieldError(err))
+		return false
+	}
+	return true
+}
+
+func verifySignature(keys map[string]SigningKey, inst Instance) error {
+	if inst.sig.KeyID == "" {
+		return errors.New("registration is not signed")
+	}
+	key, ex := keys[inst.sig.KeyID]
+	if !ex {
+		return errors.Errorf("untrusted signing key %q", inst.sig.KeyID)
+	}
+	sig, err := base64.StdEncoding.DecodeString(inst.sig.Value)
+	if err != nil || !key.verify(signingPayload(inst), sig) {
+		return errors.Errorf("invalid signature by key %q", inst.sig.KeyID)
+	}
+	return nil
+}
+
+// verifiedInstances 过滤掉签名校验失败的实例
+func (b *pluginBase) verifiedInstances(instances []Instance) []Instance {
+	out := make([]Instance, 0, len(instances))
+	for _, inst := range instances {
+		if b.verifyInstance(inst) {
+			out = append(out, inst)
+		}
+	}
+	return out
+}
@@ -0,0 +1,164 @@
+package grpc_discover
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func newTestEd25519Key(t *testing.T, id string) (SigningKey, ed25519.PublicKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewEd25519Key(id, private), public
+}
+
+func newSigningBase(t *testing.T, opts ...Option) pluginBase {
+	t.Helper()
+	base, err := newPluginBase("fake", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base
+}
+
+func signedTestInstance() Instance {
+	return Instance{
+		ServerID:    getInstanceServerID("", "GreeterServer", "pod-0"),
+		ServiceName: "GreeterServer",
+		Address:     "10.0.0.5:8080",
+		Version:     "v2",
+		Tags:        []string{"canary"},
+		Metadata:    map[string]string{"zone": "us-east-1a"},
+		Ports:       map[string]string{"grpc": "10.0.0.5:8080", "admin": "10.0.0.5:9090"},
+		Status:      StatusServing,
+	}
+}
+
+// storedCopies inst 经过 etcd / redis 的编码和 consul meta 往返后的结果
+func storedCopies(inst Instance) map[string]Instance {
+	entry := &consulapi.ServiceEntry{Service: &consulapi.AgentService{
+		ID:      inst.ServerID,
+		Address: "10.0.0.5",
+		Port:    8080,
+		Tags:    inst.Tags,
+		Meta:    consulMeta(inst),
+	}}
+	return map[string]Instance{
+		"kv":     decodeInstance(inst.ServerID, inst.ServiceName, encodeInstance(inst)),
+		"consul": consulInstances("", inst.ServiceName, []*consulapi.ServiceEntry{entry})[0],
+	}
+}
+
+func TestSigningRoundTrip(t *testing.T) {
+	ed, public := newTestEd25519Key(t, "ed-1")
+	keys := map[string]struct {
+		sign, verify SigningKey
+	}{
+		"hmac":    {NewHMACKey("hmac-1", []byte("secret")), NewHMACKey("hmac-1", []byte("secret"))},
+		"ed25519": {ed, NewEd25519PublicKey("ed-1", public)},
+	}
+	for name, k := range keys {
+		server := newSigningBase(t, WithSigningKey(k.sign))
+		client := newSigningBase(t, WithTrustedKeys(k.verify))
+
+		for store, inst := range storedCopies(server.signInstance(signedTestInstance())) {
+			if err := verifySignature(client.opt.trustedKeys, inst); err != nil {
+				t.Errorf("%s via %s: %v", name, store, err)
+			}
+		}
+	}
+}
+
+func TestSigningDetectsChanges(t *testing.T) {
+	key := NewHMACKey("hmac-1", []byte("secret"))
+	server := newSigningBase(t, WithSigningKey(key))
+	client := newSigningBase(t, WithTrustedKeys(key))
+	signed := server.signInstance(signedTestInstance())
+
+	changes := map[string]func(*Instance){
+		"address":  func(i *Instance) { i.Address = "10.0.0.6:8080" },
+		"version":  func(i *Instance) { i.Version = "v3" },
+		"tags":     func(i *Instance) { i.Tags = []string{"stable"} },
+		"metadata": func(i *Instance) { i.Metadata = map[string]string{"zone": "us-east-1b"} },
+		"ports":    func(i *Instance) { i.Ports = map[string]string{"grpc": "10.0.0.6:8080"} },
+		"status":   func(i *Instance) { i.Status = StatusDraining },
+		"serverID": func(i *Instance) { i.ServerID = getInstanceServerID("", "OtherServer", "pod-0") },
+	}
+	for name, change := range changes {
+		inst := signed
+		change(&inst)
+		err := verifySignature(client.opt.trustedKeys, inst)
+		if err == nil || !strings.Contains(err.Error(), "invalid signature") {
+			t.Errorf("changed %s: %v, want invalid signature", name, err)
+		}
+		if client.verifyInstance(inst) {
+			t.Errorf("changed %s: verifyInstance = true", name)
+		}
+	}
+	if !client.verifyInstance(signed) {
+		t.Fatal("unchanged instance failed verification")
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	oldKey := NewHMACKey("2023", []byte("old secret"))
+	newKey, _ := newTestEd25519Key(t, "2024")
+
+	oldServer := newSigningBase(t, WithSigningKey(oldKey))
+	newServer := newSigningBase(t, WithSigningKey(newKey))
+	client := newSigningBase(t, WithTrustedKeys(oldKey, newKey))
+
+	signedOld := oldServer.signInstance(signedTestInstance())
+	signedNew := newServer.signInstance(signedTestInstance())
+	got := client.verifiedInstances([]Instance{signedOld, signedNew})
+	if len(got) != 2 {
+		t.Fatalf("verified %d of 2 instances during rotation", len(got))
+	}
+
+	// 移除旧密钥后旧签名不再被接受
+	client = newSigningBase(t, WithTrustedKeys(newKey))
+	err := verifySignature(client.opt.trustedKeys, signedOld)
+	if err == nil || !strings.Contains(err.Error(), `untrusted signing key "2023"`) {
+		t.Fatalf("old signature after rotation = %v, want untrusted key", err)
+	}
+
+	// 相同 ID 的不同密钥签名无效
+	forger := newSigningBase(t, WithSigningKey(NewHMACKey("2023", []byte("guess"))))
+	forged := forger.signInstance(signedTestInstance())
+	if err := verifySignature(map[string]SigningKey{"2023": oldKey}, forged); err == nil {
+		t.Fatal("signature by a different secret with the same key ID verified")
+	}
+}
+
+func TestSigningRejectsUnsigned(t *testing.T) {
+	key := NewHMACKey("hmac-1", []byte("secret"))
+	client := newSigningBase(t, WithTrustedKeys(key))
+	unsigned := signedTestInstance()
+
+	for store, inst := range storedCopies(unsigned) {
+		err := verifySignature(client.opt.trustedKeys, inst)
+		if err == nil || !strings.Contains(err.Error(), "not signed") {
+			t.Errorf("unsigned via %s: %v, want not signed", store, err)
+		}
+	}
+	if got := client.verifiedInstances([]Instance{unsigned}); len(got) != 0 {
+		t.Fatalf("verifiedInstances kept %d unsigned instances", len(got))
+	}
+
+	// 未配置受信任密钥时不校验
+	if open := newSigningBase(t); !open.verifyInstance(unsigned) {
+		t.Fatal("verifyInstance without trusted keys rejected an unsigned instance")
+	}
+
+	// 只能校验的公钥不能用于签名
+	_, err := newPluginBase("fake", []Option{WithSigningKey(NewEd25519PublicKey("ed-1", make(ed25519.PublicKey, ed25519.PublicKeySize)))})
+	if err == nil || !strings.Contains(err.Error(), "can only verify") {
+		t.Fatalf("public key as signing key = %v, want error", err)
+	}
+}
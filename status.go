@@ -0,0 +1,107 @@
+package grpc_discover
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// InstanceStatus 实例状态, 存储在注册信息中, 可通过 SetStatus 在运行时修改
+type InstanceStatus string
+
+const (
+	StatusServing  InstanceStatus = "serving"  // 正常接收流量, 默认
+	StatusDraining InstanceStatus = "draining" // 即将下线, resolver 不再下发, 已有请求继续完成
+	StatusDisabled InstanceStatus = "disabled" // 临时停用, resolver 不再下发
+)
+
+func (s InstanceStatus) validate() error {
+	switch s {
+	case StatusServing, StatusDraining, StatusDisabled:
+		return nil
+	}
+	return errors.Errorf("grpc_discover: unknown instance status %q", s)
+}
+
+// stored 注册信息中存储的状态, serving 不存储, 兼容旧版本客户端
+func (s InstanceStatus) stored() string {
+	if s == StatusServing {
+		return ""
+	}
+	return string(s)
+}
+
+// parseStoredStatus 解析注册信息中的状态, 未存储时为 serving
+func parseStoredStatus(s string) InstanceStatus {
+	if s == "" {
+		return StatusServing
+	}
+	return InstanceStatus(s)
+}
+
+// Serving 实例是否应当接收新的请求
+func (i Instance) Serving() bool {
+	return i.Status == StatusServing || i.Status == ""
+}
+
+// servingInstances 过滤掉 draining / disabled 的实例
+func servingInstances(instances []Instance) []Instance {
+	out := make([]Instance, 0, len(instances))
+	for _, inst := range instances {
+		if inst.Serving() {
+			out = append(out, inst)
+		}
+	}
+	return out
+}
+
+// WithDrainTimeout UnRegister 和 Close 时先将实例标记为 draining, 等待 timeout
+// 让客户端停止发送新请求并完成已有请求, 再删除注册信息. 默认为 0, 立即删除
+func WithDrainTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.drainTimeout = timeout
+	}
+}
+
+// drainReserve drain 在 ctx 截止前留给删除注册信息的时间
+const drainReserve = time.Second
+
+// drain 配置了 WithDrainTimeout 时将 serverIDs 标记为 draining 并等待, 最多等到 ctx
+// 截止前 drainReserve. 返回用于随后删除注册信息的 ctx, ctx 在等待期间结束时为独立的
+// 短超时 ctx, 保证注册信息仍然被删除
+func (b *pluginBase) drain(ctx context.Context, serverIDs []string, setStatus func(context.Context, string, InstanceStatus) error) (context.Context, context.CancelFunc) {
+	if b.opt.drainTimeout <= 0 || len(serverIDs) == 0 {
+		return ctx, func() {}
+	}
+
+	drained := 0
+	for _, serverID := range serverIDs {
+		if err := setStatus(ctx, serverID, StatusDraining); err != nil {
+			b.logger.Warn("drain", fieldServerID(serverID), fieldError(err))
+			continue
+		}
+		drained++
+	}
+
+	wait := b.opt.drainTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline) - drainReserve; left < wait {
+			wait = left
+		}
+	}
+	if drained > 0 && wait > 0 {
+		b.logger.Info("drain", Any("instances", drained), Any("timeout", wait))
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+
+	if ctx.Err() != nil {
+		return context.WithTimeout(context.Background(), drainReserve)
+	}
+	return ctx, func() {}
+}
@@ -0,0 +1,134 @@
+package grpc_discover
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// instanceFilter dial target 查询参数描述的实例过滤条件
+//
+//	etcd:///GreeterServer?version=v2&zone=us-east-1a&tag=canary&meta.team=core
+//
+// version 匹配 WithVersion, tag 可以重复且全部匹配 WithTags, zone 是
+// meta.zone 的简写, meta.<key> 匹配 WithMetadata. 其它参数视为错误.
+type instanceFilter struct {
+	version  string
+	tags     []string
+	metadata map[string]string
+}
+
+func parseInstanceFilter(query url.Values) (instanceFilter, error) {
+	var f instanceFilter
+	for key, values := range query {
+		value := values[len(values)-1]
+		switch {
+		case key == "version":
+			f.version = value
+		case key == "tag":
+			f.tags = append(f.tags, values...)
+		case key == "zone":
+			f.setMetadata("zone", value)
+		case strings.HasPrefix(key, "meta.") && len(key) > len("meta."):
+			f.setMetadata(strings.TrimPrefix(key, "meta."), value)
+		default:
+			return instanceFilter{}, fmt.Errorf("grpc_discover: unknown dial target parameter %q", key)
+		}
+	}
+	return f, nil
+}
+
+func (f *instanceFilter) setMetadata(key string, value string) {
+	if f.metadata == nil {
+		f.metadata = map[string]string{}
+	}
+	f.metadata[key] = value
+}
+
+func (f instanceFilter) match(inst Instance) bool {
+	if f.version != "" && inst.Version != f.version {
+		return false
+	}
+	for _, tag := range f.tags {
+		if !containsString(inst.Tags, tag) {
+			return false
+		}
+	}
+	for k, v := range f.metadata {
+		if inst.Metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (f instanceFilter) apply(instances []Instance) []Instance {
+	if f.version == "" && len(f.tags) == 0 && len(f.metadata) == 0 {
+		return instances
+	}
+
+	out := make([]Instance, 0, len(instances))
+	for _, inst := range instances {
+		if f.match(inst) {
+			out = append(out, inst)
+		}
+	}
+	return out
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// targetEndpoint 解析 dial target 的路径: <serverName>, 或指向单个实例的
+// <serverName>/id/<serverID>, 其中 serverID 可以是完整的 serverID 或实例 ID:
+//
+//	etcd:///GreeterServer/id/grpc-discover/GreeterServer/pod-0
+//	etcd:///GreeterServer/id/pod-0
+//
+// 完整 serverID 的各段经过 PathEscape (例如 %2F), 因此在转义后的路径上切分,
+// 返回的 serverID 保持转义形式
+func targetEndpoint(target resolver.Target) (serviceName string, serverID string) {
+	path := strings.TrimPrefix(target.URL.EscapedPath(), "/")
+	if path == "" {
+		path = target.URL.Opaque
+	}
+	if i := strings.Index(path, "/id/"); i > 0 {
+		serviceName, err := url.PathUnescape(path[:i])
+		if err != nil {
+			serviceName = path[:i]
+		}
+		return serviceName, path[i+len("/id/"):]
+	}
+	return target.Endpoint(), ""
+}
+
+// matchServerID inst 是否为 dial target 中指定的实例, serverID 为 targetEndpoint
+// 返回的转义形式
+func matchServerID(inst Instance, serverID string) bool {
+	if inst.ServerID == serverID {
+		return true
+	}
+	id, err := url.PathUnescape(serverID)
+	if err != nil {
+		return false
+	}
+	_, _, instanceID, err := parseServerID(inst.ServerID)
+	return err == nil && instanceID == id
+}
+
+// targetQuery 解析 dial target 的查询参数
+func targetQuery(target resolver.Target) (url.Values, error) {
+	query, err := url.ParseQuery(target.URL.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("grpc_discover: invalid dial target query %q: %w", target.URL.RawQuery, err)
+	}
+	return query, nil
+}
@@ -0,0 +1,38 @@
+package grpc_discover
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestTargetServerIDEscaped(t *testing.T) {
+	serverID := getInstanceServerID("team/a", "pkg.Service/v1", "pod;0/1")
+	inst := Instance{ServerID: serverID, ServiceName: "pkg.Service/v1"}
+
+	// 服务名和 serverID 都按 dial target 的写法转义
+	target := "etcd:///" + url.PathEscape("pkg.Service/v1") + "/id/" + serverID
+	serviceName, id := targetEndpoint(mustTarget(t, target))
+	if serviceName != "pkg.Service/v1" {
+		t.Fatalf("serviceName = %q, want %q", serviceName, "pkg.Service/v1")
+	}
+	if id != serverID {
+		t.Fatalf("serverID = %q, want %q", id, serverID)
+	}
+	if !matchServerID(inst, id) {
+		t.Fatalf("matchServerID(%q) = false", id)
+	}
+
+	// 只写实例 ID 时同样按转义形式书写
+	_, id = targetEndpoint(mustTarget(t, "etcd:///pkg.Service%2Fv1/id/"+url.PathEscape("pod;0/1")))
+	if !matchServerID(inst, id) {
+		t.Fatalf("matchServerID(%q) = false for instance ID", id)
+	}
+	if matchServerID(inst, "pod") {
+		t.Fatal("matchServerID matched another instance ID")
+	}
+
+	serviceName, id = targetEndpoint(mustTarget(t, "etcd:///GreeterServer"))
+	if serviceName != "GreeterServer" || id != "" {
+		t.Fatalf("targetEndpoint = %q, %q", serviceName, id)
+	}
+}
@@ -0,0 +1,250 @@
+package grpc_discover
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/credentials"
+)
+
+// TLSConfig 连接注册中心使用的 TLS / mTLS 配置, 对 etcd、consul、redis 通用, 证书文件修改后自动重新加载
+type TLSConfig struct {
+	CAFile   string // 校验服务端证书的 CA, 为空时使用系统 CA
+	CertFile string // mTLS 客户端证书
+	KeyFile  string // mTLS 客户端私钥
+
+	// ServerName SNI 和校验使用的服务端名称, 为空时取连接地址的主机名或 IP,
+	// 按 IP 连接时校验证书的 IP SAN
+	ServerName         string
+	InsecureSkipVerify bool // 不校验服务端证书, 仅用于测试
+}
+
+// WithTLS 使用 TLSConfig 连接注册中心, 覆盖插件配置中已有的 TLS 设置
+func WithTLS(config TLSConfig) Option {
+	return func(o *options) {
+		o.tls = &config
+	}
+}
+
+// ClientConfig 生成 *tls.Config, 证书文件在调用时读取并校验,
+// 也可用于 AuthorityConfig.TLS
+func (c TLSConfig) ClientConfig() (*tls.Config, error) {
+	return c.clientConfig(NopLogger{})
+}
+
+// clientConfig 热加载失败时继续使用上一次成功加载的证书, 并通过 logger 报告
+func (c TLSConfig) clientConfig(logger Logger) (*tls.Config, error) {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("grpc_discover: tls: CertFile and KeyFile must be set together")
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CertFile != "" {
+		cert := &reloadingFile[*tls.Certificate]{
+			logger: logger,
+			paths:  []string{c.CertFile, c.KeyFile},
+			load: func() (*tls.Certificate, error) {
+				cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+				if err != nil {
+					return nil, errors.Wrapf(err, "grpc_discover: tls: load client certificate %s / %s", c.CertFile, c.KeyFile)
+				}
+				return &cert, nil
+			},
+		}
+		if _, err := cert.get(); err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert.get()
+		}
+	}
+
+	if c.CAFile != "" && !c.InsecureSkipVerify {
+		ca := &reloadingFile[*x509.CertPool]{
+			logger: logger,
+			paths:  []string{c.CAFile},
+			load: func() (*x509.CertPool, error) {
+				pem, err := os.ReadFile(c.CAFile)
+				if err != nil {
+					return nil, errors.Wrapf(err, "grpc_discover: tls: read CA %s", c.CAFile)
+				}
+				pool := x509.NewCertPool()
+				if !pool.AppendCertsFromPEM(pem) {
+					return nil, errors.Errorf("grpc_discover: tls: no certificates found in CA %s", c.CAFile)
+				}
+				return pool, nil
+			},
+		}
+		if _, err := ca.get(); err != nil {
+			return nil, err
+		}
+
+		// 默认校验只能使用固定的 RootCAs, 改为在 VerifyConnection 中用最新的 CA 校验
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			roots, err := ca.get()
+			if err != nil {
+				return err
+			}
+			return verifyPeer(cs, roots, c.ServerName)
+		}
+	}
+
+	return config, nil
+}
+
+// verifyPeer 按 roots 校验服务端证书链和名称. 名称取配置的 serverName, 其次是握手的
+// SNI (IP 由 tlsForAddress 补全); 两者都为空时拒绝连接, 不能跳过名称校验
+func verifyPeer(cs tls.ConnectionState, roots *x509.CertPool, serverName string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("grpc_discover: tls: server presented no certificate")
+	}
+	if serverName == "" {
+		serverName = cs.ServerName
+	}
+	if serverName == "" {
+		return errors.New("grpc_discover: tls: no server name to verify, set TLSConfig.ServerName when connecting to an IP address")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+		return errors.Wrap(err, "grpc_discover: tls: verify server certificate")
+	}
+	return nil
+}
+
+// tlsForAddress 按连接地址补全 ServerName 和 VerifyConnection 校验使用的名称, 各插件
+// 在每次握手时调用: redis 客户端直接使用, etcd 见 addressCredentials, consul 见 setTransportTLS
+func tlsForAddress(config *tls.Config, address string) *tls.Config {
+	if config == nil || config.ServerName != "" {
+		return config
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	config = config.Clone()
+	config.ServerName = host
+	if verify := config.VerifyConnection; verify != nil {
+		// IP 不会出现在 SNI 中, 用连接地址补全校验使用的名称
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if cs.ServerName == "" {
+				cs.ServerName = host
+			}
+			return verify(cs)
+		}
+	}
+	return config
+}
+
+// addressCredentials 每次握手按 authority 调用 tlsForAddress 的 gRPC 传输凭证, 用于 etcd
+type addressCredentials struct {
+	credentials.TransportCredentials
+	config *tls.Config
+}
+
+func newAddressCredentials(config *tls.Config) credentials.TransportCredentials {
+	return &addressCredentials{TransportCredentials: credentials.NewTLS(config), config: config}
+}
+
+func (c *addressCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return credentials.NewTLS(tlsForAddress(c.config, authority)).ClientHandshake(ctx, authority, conn)
+}
+
+func (c *addressCredentials) Clone() credentials.TransportCredentials {
+	return newAddressCredentials(c.config.Clone())
+}
+
+// setTransportTLS transport 使用 config 连接 consul, 每次握手按连接地址调用 tlsForAddress
+func setTransportTLS(transport *http.Transport, config *tls.Config) {
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	}
+	transport.TLSClientConfig = config
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, tlsForAddress(config, addr))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+// reloadingFile 文件修改时间变化时重新加载的内容. 加载失败时继续使用上一次的
+// 结果并在下次调用时重试, 从未加载成功时返回错误
+type reloadingFile[T any] struct {
+	logger Logger
+	paths  []string
+	load   func() (T, error)
+
+	mu      sync.Mutex
+	value   T
+	modTime []time.Time
+}
+
+func (f *reloadingFile[T]) get() (T, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	modTime := make([]time.Time, len(f.paths))
+	changed := f.modTime == nil
+	for i, path := range f.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			err = errors.Wrap(err, "grpc_discover: tls")
+			if f.modTime != nil {
+				f.logger.Warn("tls reload", fieldError(err))
+				return f.value, nil
+			}
+			var zero T
+			return zero, err
+		}
+		modTime[i] = info.ModTime()
+		if !changed && !modTime[i].Equal(f.modTime[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return f.value, nil
+	}
+
+	value, err := f.load()
+	if err != nil {
+		if f.modTime != nil {
+			// 例如证书和私钥只替换了一个, 等下次握手再试
+			f.logger.Warn("tls reload", fieldError(err))
+			return f.value, nil
+		}
+		var zero T
+		return zero, err
+	}
+	f.value = value
+	f.modTime = modTime
+	return value, nil
+}
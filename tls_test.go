@@ -0,0 +1,387 @@
+package grpc_discover
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+	kpem []byte
+}
+
+var testSerial int64
+
+// newTestCert 生成证书, parent 为 nil 时生成自签名 CA
+func newTestCert(t *testing.T, parent *testCert, cn string, dnsNames []string, ips []net.IP) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		kpem: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}),
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	cert, err := tls.X509KeyPair(c.pem, c.kpem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// writeFile 写入文件并把修改时间设为 mod, 保证热加载能观察到变化
+func writeFile(t *testing.T, path string, data []byte, mod time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tlsServer 接受 TLS 连接并完成握手, clientCAs 不为 nil 时要求客户端证书
+func tlsServer(t *testing.T, cert tls.Certificate, clientCAs *x509.CertPool) string {
+	t.Helper()
+	return tlsServerAt(t, "127.0.0.1", cert, clientCAs)
+}
+
+// tlsServerAt 在 host 上监听的 tlsServer
+func tlsServerAt(t *testing.T, host string, cert tls.Certificate, clientCAs *x509.CertPool) string {
+	t.Helper()
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	ln, err := tls.Listen("tcp", net.JoinHostPort(host, "0"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func dialTLS(addr string, config *tls.Config) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// TLS 1.3 中客户端证书错误在握手后的第一次读取时才返回
+	_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil
+	}
+	if err != nil && strings.Contains(err.Error(), "EOF") {
+		return nil
+	}
+	return err
+}
+
+type tlsFixture struct {
+	dir    string
+	ca     *testCert
+	server *testCert
+	client *testCert
+	caFile string
+}
+
+func newTLSFixture(t *testing.T) *tlsFixture {
+	t.Helper()
+	f := &tlsFixture{dir: t.TempDir()}
+	f.ca = newTestCert(t, nil, "test ca", nil, nil)
+	f.server = newTestCert(t, f.ca, "registry", []string{"registry.test"}, []net.IP{net.ParseIP("127.0.0.1")})
+	f.client = newTestCert(t, f.ca, "client", nil, nil)
+	f.caFile = filepath.Join(f.dir, "ca.pem")
+	writeFile(t, f.caFile, f.ca.pem, time.Now().Add(-time.Minute))
+	return f
+}
+
+func (f *tlsFixture) clientFiles(t *testing.T) (string, string) {
+	t.Helper()
+	certFile, keyFile := filepath.Join(f.dir, "client.pem"), filepath.Join(f.dir, "client-key.pem")
+	writeFile(t, certFile, f.client.pem, time.Now().Add(-time.Minute))
+	writeFile(t, keyFile, f.client.kpem, time.Now().Add(-time.Minute))
+	return certFile, keyFile
+}
+
+func TestTLSCAOnly(t *testing.T) {
+	f := newTLSFixture(t)
+	addr := tlsServer(t, f.server.tlsCertificate(t), nil)
+
+	config, err := TLSConfig{CAFile: f.caFile, ServerName: "registry.test"}.ClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dialTLS(addr, config); err != nil {
+		t.Fatalf("dial with CA: %v", err)
+	}
+
+	// 通过 IP 连接时可以用 IP 作为 ServerName
+	config, err = TLSConfig{CAFile: f.caFile, ServerName: "127.0.0.1"}.ClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dialTLS(addr, config); err != nil {
+		t.Fatalf("dial with IP server name: %v", err)
+	}
+}
+
+func TestTLSIPWithoutServerName(t *testing.T) {
+	f := newTLSFixture(t)
+	addr := tlsServer(t, f.server.tlsCertificate(t), nil)
+
+	config, err := TLSConfig{CAFile: f.caFile}.ClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dialTLS(addr, config)
+	if err == nil || !strings.Contains(err.Error(), "no server name to verify") {
+		t.Fatalf("dial IP without ServerName = %v, want refusal", err)
+	}
+
+	// tlsForAddress 用连接地址补全名称, 与 redis 插件相同
+	if err := dialTLS(addr, tlsForAddress(config, addr)); err != nil {
+		t.Fatalf("dial with address server name: %v", err)
+	}
+}
+
+func TestTLSMutual(t *testing.T) {
+	f := newTLSFixture(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(f.ca.cert)
+	addr := tlsServer(t, f.server.tlsCertificate(t), pool)
+
+	certFile, keyFile := f.clientFiles(t)
+	config, err := TLSConfig{CAFile: f.caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "registry.test"}.ClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dialTLS(addr, config); err != nil {
+		t.Fatalf("dial with client certificate: %v", err)
+	}
+
+	config, err = TLSConfig{CAFile: f.caFile, ServerName: "registry.test"}.ClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dialTLS(addr, config); err == nil {
+		t.Fatal("dial without client certificate succeeded")
+	}
+}
+
+func TestTLSWrongCA(t *testing.T) {
+	f := newTLSFixture(t)
+	addr := tlsServer(t, f.server.tlsCertificate(t), nil)
+
+	other := newTestCert(t, nil, "other ca", nil, nil)
+	otherFile := filepath.Join(f.dir, "other-ca.pem")
+	writeFile(t, otherFile, other.pem, time.Now())
+
+	config, err := TLSConfig{CAFile: otherFile, ServerName: "registry.test"}.ClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dialTLS(addr, config); err == nil || !strings.Contains(err.Error(), "verify server certificate") {
+		t.Fatalf("dial with wrong CA = %v, want verification error", err)
+	}
+}
+
+func TestTLSWrongSAN(t *testing.T) {
+	f := newTLSFixture(t)
+	addr := tlsServer(t, f.server.tlsCertificate(t), nil)
+
+	config, err := TLSConfig{CAFile: f.caFile, ServerName: "other.test"}.ClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dialTLS(addr, config); err == nil || !strings.Contains(err.Error(), "verify server certificate") {
+		t.Fatalf("dial with wrong SAN = %v, want verification error", err)
+	}
+}
+
+func TestTLSCertKeyPairing(t *testing.T) {
+	f := newTLSFixture(t)
+	certFile, keyFile := f.clientFiles(t)
+
+	for _, c := range []TLSConfig{{CertFile: certFile}, {KeyFile: keyFile}} {
+		_, err := c.ClientConfig()
+		if err == nil || !strings.Contains(err.Error(), "CertFile and KeyFile must be set together") {
+			t.Fatalf("ClientConfig(%+v) = %v, want pairing error", c, err)
+		}
+	}
+
+	_, err := TLSConfig{CertFile: certFile, KeyFile: filepath.Join(f.dir, "missing.pem")}.ClientConfig()
+	if err == nil || !strings.Contains(err.Error(), "missing.pem") {
+		t.Fatalf("missing key = %v, want error naming the file", err)
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	f := newTLSFixture(t)
+	config, err := TLSConfig{CAFile: f.caFile, ServerName: "registry.test"}.ClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 服务端换成新 CA 签发的证书, 旧 CA 校验失败
+	ca2 := newTestCert(t, nil, "rotated ca", nil, nil)
+	server2 := newTestCert(t, ca2, "registry", []string{"registry.test"}, nil)
+	addr := tlsServer(t, server2.tlsCertificate(t), nil)
+	if err := dialTLS(addr, config); err == nil {
+		t.Fatal("dial before CA rotation succeeded")
+	}
+
+	// 重写 CA 文件后下一次握手使用新 CA, 不需要重新创建配置
+	writeFile(t, f.caFile, append(append([]byte{}, f.ca.pem...), ca2.pem...), time.Now())
+	if err := dialTLS(addr, config); err != nil {
+		t.Fatalf("dial after CA rotation: %v", err)
+	}
+
+	// 写入无效内容时保留上一次的 CA
+	writeFile(t, f.caFile, []byte("not a certificate"), time.Now().Add(time.Minute))
+	if err := dialTLS(addr, config); err != nil {
+		t.Fatalf("dial after invalid CA rewrite: %v", err)
+	}
+}
+
+func TestTLSIPSANPerEndpoint(t *testing.T) {
+	f := newTLSFixture(t)
+	// 两个节点只通过 IP 访问, 证书中只有各自的 IP SAN, 无法共用一个 ServerName
+	server1 := newTestCert(t, f.ca, "node1", nil, []net.IP{net.ParseIP("127.0.0.1")})
+	server2 := newTestCert(t, f.ca, "node2", nil, []net.IP{net.ParseIP("127.0.0.2")})
+	addr1 := tlsServerAt(t, "127.0.0.1", server1.tlsCertificate(t), nil)
+	addr2 := tlsServerAt(t, "127.0.0.2", server2.tlsCertificate(t), nil)
+
+	config, err := TLSConfig{CAFile: f.caFile}.ClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := newAddressCredentials(config)
+	for _, addr := range []string{addr1, addr2} {
+		// etcd: gRPC 握手时 authority 为 endpoint 地址
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConn, _, err := creds.ClientHandshake(context.Background(), addr, conn)
+		if err != nil {
+			t.Fatalf("gRPC handshake with %s: %v", addr, err)
+		}
+		tlsConn.Close()
+
+		// consul: http.Transport 按连接地址握手
+		transport := &http.Transport{}
+		setTransportTLS(transport, config)
+		conn, err = transport.DialTLSContext(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("transport handshake with %s: %v", addr, err)
+		}
+		conn.Close()
+	}
+
+	// 地址与证书不符时仍然拒绝
+	conn, err := net.Dial("tcp", addr2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	wrong := "127.0.0.1" + addr2[strings.LastIndex(addr2, ":"):]
+	if _, _, err := creds.ClientHandshake(context.Background(), wrong, conn); err == nil || !strings.Contains(err.Error(), "verify server certificate") {
+		t.Fatalf("handshake with mismatched IP = %v, want verification error", err)
+	}
+}
+
+func TestTLSConsulTransportIP(t *testing.T) {
+	f := newTLSFixture(t)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{f.server.tlsCertificate(t)}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	config, err := TLSConfig{CAFile: f.caFile}.ClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &http.Transport{}
+	setTransportTLS(transport, config)
+	defer transport.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: transport, Timeout: 5 * time.Second}).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET %s: %v", srv.URL, err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,53 @@
+package grpc_discover
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/dollarkillerx/grpc_discover"
+
+// span attribute keys
+const (
+	attrBackend   = attribute.Key("grpc_discover.backend")
+	attrService   = attribute.Key("grpc_discover.service")
+	attrServerID  = attribute.Key("grpc_discover.server_id")
+	attrAddress   = attribute.Key("grpc_discover.address")
+	attrInstances = attribute.Key("grpc_discover.instances")
+	attrGroupID   = attribute.Key("grpc_discover.group_id")
+)
+
+// WithTracerProvider 设置 OpenTelemetry TracerProvider, 默认使用 otel 全局 provider
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *options) {
+		o.tracerProvider = tp
+	}
+}
+
+func newTracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// startSpan 以调用方 ctx 为父 span 开启一个注册中心操作 span
+func startSpan(ctx context.Context, tracer trace.Tracer, name string, backend string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "grpc_discover."+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(append(attrs, attrBackend.String(backend))...),
+	)
+}
+
+// endSpan 记录错误并结束 span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,253 @@
+package grpc_discover
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// TrafficSplitBalancerName 按注册中心中的流量拆分规则分配请求的 balancer 名称:
+//
+//	{"loadBalancingConfig":[{"grpc_discover_traffic_split":{"hashHeader":"x-user-id"}}]}
+const TrafficSplitBalancerName = "grpc_discover_traffic_split"
+
+// trafficSplitRoot 流量拆分规则的 key 前缀, 与 service config 相同的形式:
+//
+//	grpc-discover-split/<serverName>
+//	grpc-discover-split@<namespace>/<serverName>
+const trafficSplitRoot = "grpc-discover-split"
+
+func getTrafficSplitKey(namespace string, serviceName string) string {
+	root := trafficSplitRoot
+	if namespace != "" {
+		root += "@" + url.PathEscape(namespace)
+	}
+	return root + "/" + url.PathEscape(serviceName)
+}
+
+// TrafficSplit 服务的流量拆分规则, 例如 10% 到 v2, 90% 到 v1:
+//
+//	&TrafficSplit{Routes: []TrafficRoute{
+//		{Version: "v2", Weight: 10},
+//		{Version: "v1", Weight: 90},
+//	}}
+type TrafficSplit struct {
+	Routes []TrafficRoute `json:"routes"`
+}
+
+// TrafficRoute 一组实例及其流量权重, Version 和 Metadata 为空时匹配所有实例
+type TrafficRoute struct {
+	Version  string            `json:"version,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Weight   int               `json:"weight"`
+}
+
+func (r TrafficRoute) match(inst Instance) bool {
+	if r.Version != "" && inst.Version != r.Version {
+		return false
+	}
+	for k, v := range r.Metadata {
+		if inst.Metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *TrafficSplit) validate() error {
+	if len(s.Routes) == 0 {
+		return errors.New("grpc_discover: traffic split has no routes")
+	}
+	total := 0
+	for _, route := range s.Routes {
+		if route.Weight < 0 {
+			return errors.Errorf("grpc_discover: traffic split weight %d is negative", route.Weight)
+		}
+		total += route.Weight
+	}
+	if total == 0 {
+		return errors.New("grpc_discover: traffic split weights sum to zero")
+	}
+	return nil
+}
+
+// encodeTrafficSplit split 为 nil 时返回 "", 即删除规则
+func encodeTrafficSplit(split *TrafficSplit) (string, error) {
+	if split == nil {
+		return "", nil
+	}
+	if err := split.validate(); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(split)
+	return string(data), err
+}
+
+func decodeTrafficSplit(value string) (*TrafficSplit, error) {
+	var split TrafficSplit
+	if err := json.Unmarshal([]byte(value), &split); err != nil {
+		return nil, errors.Wrap(err, "grpc_discover: traffic split")
+	}
+	if err := split.validate(); err != nil {
+		return nil, err
+	}
+	return &split, nil
+}
+
+func init() {
+	balancer.Register(&discoverBalancerBuilder{
+		name:        TrafficSplitBalancerName,
+		parseConfig: parseTrafficSplitConfig,
+		newPicker: func() pickerBuilder {
+			return &trafficSplitPickerBuilder{config: defaultTrafficSplitConfig()}
+		},
+	})
+}
+
+type trafficSplitConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	HashHeader string `json:"hashHeader,omitempty"` // 读取哈希 key 的 metadata, 默认 x-hash-key
+}
+
+func defaultTrafficSplitConfig() *trafficSplitConfig {
+	return &trafficSplitConfig{HashHeader: defaultHashHeader}
+}
+
+func parseTrafficSplitConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	config := defaultTrafficSplitConfig()
+	if err := json.Unmarshal(js, config); err != nil {
+		return nil, errors.Wrap(err, "grpc_discover: traffic split config")
+	}
+	config.HashHeader = strings.ToLower(config.HashHeader)
+	return config, nil
+}
+
+type trafficSplitPickerBuilder struct {
+	instances addressInstances
+
+	mu     sync.Mutex
+	config *trafficSplitConfig
+	split  *TrafficSplit
+}
+
+func (b *trafficSplitPickerBuilder) setState(s balancer.ClientConnState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c, ok := s.BalancerConfig.(*trafficSplitConfig); ok {
+		b.config = c
+	}
+	b.split = nil
+	if info, ok := resolverInfoFrom(s.ResolverState); ok {
+		b.split = info.split
+	}
+	b.instances.update(s.ResolverState)
+}
+
+func (b *trafficSplitPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	b.mu.Lock()
+	config, split := b.config, b.split
+	b.mu.Unlock()
+
+	all := make([]splitSubConn, 0, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		inst, ok := b.instances.lookup(sci.Address)
+		key := sci.Address.Addr
+		if ok && inst.ServerID != "" {
+			key = inst.ServerID
+		}
+		all = append(all, splitSubConn{sc: sc, key: key, inst: inst})
+	}
+	// 按 key 排序, 使无 key 请求的随机选择与 map 遍历顺序无关
+	sort.Slice(all, func(i, j int) bool { return all[i].key < all[j].key })
+
+	p := &trafficSplitPicker{config: config}
+	if split != nil {
+		routes := make([]splitRoute, len(split.Routes))
+		for _, s := range all {
+			for i, route := range split.Routes {
+				if route.match(s.inst) {
+					routes[i].subConns = append(routes[i].subConns, s)
+					break
+				}
+			}
+		}
+		for i, route := range split.Routes {
+			if route.Weight > 0 && len(routes[i].subConns) > 0 {
+				routes[i].weight = route.Weight
+				p.total += route.Weight
+				p.routes = append(p.routes, routes[i])
+			}
+		}
+	}
+	if p.total == 0 {
+		// 没有规则或规则匹配不到 ready 实例时使用所有实例
+		p.routes = []splitRoute{{weight: 1, subConns: all}}
+		p.total = 1
+	}
+	return p
+}
+
+type splitSubConn struct {
+	sc   balancer.SubConn
+	key  string
+	inst Instance
+}
+
+type splitRoute struct {
+	weight   int
+	subConns []splitSubConn
+}
+
+type trafficSplitPicker struct {
+	config *trafficSplitConfig
+	routes []splitRoute
+	total  int
+}
+
+func (p *trafficSplitPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	key, ok := requestHashKey(info.Ctx, p.config.HashHeader)
+	if !ok {
+		route := p.route(rand.Float64())
+		return balancer.PickResult{SubConn: route.subConns[rand.Intn(len(route.subConns))].sc}, nil
+	}
+
+	// key 在 [0, 1) 上的位置决定路由, 权重变化时只有边界附近的 key 改变路由
+	h := hashString(key)
+	route := p.route(float64(h>>11) / (1 << 53))
+
+	// 路由内用 rendezvous hashing 选择实例, 实例增减时只影响相关的 key
+	var best splitSubConn
+	var bestScore uint64
+	for i, s := range route.subConns {
+		if score := hashString(key + "#" + s.key); i == 0 || score > bestScore {
+			best, bestScore = s, score
+		}
+	}
+	return balancer.PickResult{SubConn: best.sc}, nil
+}
+
+// route 按累计权重返回 x 所在的路由, x 在 [0, 1) 之间
+func (p *trafficSplitPicker) route(x float64) splitRoute {
+	point := x * float64(p.total)
+	acc := 0
+	for _, route := range p.routes {
+		acc += route.weight
+		if point < float64(acc) {
+			return route
+		}
+	}
+	return p.routes[len(p.routes)-1]
+}